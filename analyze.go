@@ -2,118 +2,240 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"database/sql"
 	"fmt"
 	"image"
 	"image/color"
 	"image/png"
-	"io/fs"
 	"log"
 	"os"
-	"path/filepath"
-	"strings"
+	"runtime"
+	"time"
+
+	"golang.org/x/sync/errgroup"
 )
 
 var (
+	// default palette, see paletteConfig
 	baseDarkRed = color.RGBA{169, 39, 39, 255}  // #A92727
 	baseRed     = color.RGBA{242, 78, 66, 255}  // #F24E42
 	baseYellow  = color.RGBA{255, 207, 67, 255} // #FFCF43
+	baseGreen   = color.RGBA{22, 224, 152, 255} // #16E098
 	threshold   = uint8(10)
 
+	greenValueInMask   = uint8(50)
 	yellowValueInMask  = uint8(100)
 	redValueInMask     = uint8(178)
 	darkRedValueInMask = uint8(255)
+
+	// weight of each class of congested pixels in the congestion ratio
+	yellowCongestionWeight  = 1.0 / 3
+	redCongestionWeight     = 2.0 / 3
+	darkRedCongestionWeight = 1.0
 )
 
-func analyzeScreenshots(prefix string, db *sql.DB) error {
-	log.Printf("---- analyzing screenshots for Jaipur at %v ----", prefix)
+// trafficCounts is the number of pixels of each traffic class in a tile,
+// and the number of pixels in the reference road mask of the cell.
+type trafficCounts struct {
+	Green   int
+	Yellow  int
+	Red     int
+	DarkRed int
+
+	RoadPixels int
+}
+
+func (t trafficCounts) coloredPixels() int {
+	return t.Green + t.Yellow + t.Red + t.DarkRed
+}
+
+// percent returns the count as a percentage of the road pixels of the cell.
+func (t trafficCounts) percent(count int) float64 {
+	if t.RoadPixels == 0 {
+		return 0
+	}
+	return float64(count) * 100 / float64(t.RoadPixels)
+}
+
+// congestion is the weighted congested pixels over total road pixels, in [0, 1].
+// It is 0 when there is no road in the tile.
+func (t trafficCounts) congestion() float64 {
+	road := t.coloredPixels()
+	if road == 0 {
+		return 0
+	}
+
+	congested := yellowCongestionWeight*float64(t.Yellow) +
+		redCongestionWeight*float64(t.Red) +
+		darkRedCongestionWeight*float64(t.DarkRed)
+	return congested / float64(road)
+}
+
+func analyzeScreenshots(ctx context.Context, manifest *captureManifest, p *palette, db *sql.DB) error {
+	log.Printf("---- analyzing screenshots for %v at %v ----", manifest.City, manifest.Prefix)
 	defer log.Println("---- screenshots analyzed ----")
 
-	if err := filepath.WalkDir(ssFolder, func(ssPath string, d fs.DirEntry, err error) error {
-		if err != nil {
-			return fmt.Errorf("error in walking dir [%v]: %w", ssFolder, err)
-		}
-		if d.IsDir() {
-			return nil
-		}
+	start := time.Now()
+	cells := manifest.capturedCells()
+	counts := make([]trafficCounts, len(cells))
+	segments := make([][]segmentCounts, len(cells))
 
-		info, err := d.Info()
-		if err != nil {
-			return fmt.Errorf("error in getting file info [%v]: %w", ssPath, err)
-		}
+	g, gctx := errgroup.WithContext(ctx)
+	g.SetLimit(runtime.NumCPU())
+	for i, cell := range cells {
+		g.Go(func() error {
+			if err := gctx.Err(); err != nil {
+				return err
+			}
 
-		if !strings.HasSuffix(info.Name(), ".png") {
-			return nil
-		}
+			var err error
+			counts[i], segments[i], err = analyzeScreenshot(manifest.City, cell, manifest.ssPath(cell), manifest.maskPath(cell), p)
+			return err
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return fmt.Errorf("error in analyzing screenshots [%v]: %w", manifest.Prefix, err)
+	}
 
-		if !strings.Contains(info.Name(), prefix) {
-			return nil
+	// sqlite allows a single writer, so the rows are inserted after the analysis
+	for i, cell := range cells {
+		if err := insertTraffic(ctx, db, manifest.City, manifest.ssPath(cell), counts[i]); err != nil {
+			return fmt.Errorf("error in inserting traffic [%v]: %w", manifest.ssPath(cell), err)
+		}
+		if err := insertRoadMask(ctx, db, manifest.City, cell.X, cell.Y, counts[i].RoadPixels); err != nil {
+			return fmt.Errorf("error in inserting road mask [%v, %v]: %w", cell.X, cell.Y, err)
+		}
+		if err := insertSegmentTraffic(ctx, db, manifest.City, manifest.ssPath(cell), cell.X, cell.Y, segments[i]); err != nil {
+			return fmt.Errorf("error in inserting segment traffic [%v]: %w", manifest.ssPath(cell), err)
 		}
-
-		maskPath := filepath.Join(maskFolder, info.Name())
-		return analyzeScreenshot(ssPath, maskPath, db)
-	}); err != nil {
-		return fmt.Errorf("error in walking dir for analyzing screenshots [%v]: %w", ssFolder, err)
 	}
+	log.Printf("analyzed [%v] screenshots in [%v]", len(cells), time.Since(start))
+	analysisDuration.WithLabelValues(manifest.City).Observe(time.Since(start).Seconds())
+	observeCityTraffic(manifest.City, counts)
 
-	if err := combineScreenshots(prefix); err != nil {
-		return fmt.Errorf("error in combining screenshots [%v]: %w", prefix, err)
+	if err := combineScreenshots(ctx, manifest); err != nil {
+		return fmt.Errorf("error in combining screenshots [%v]: %w", manifest.Prefix, err)
 	}
 
-	if err := combineMasks(prefix); err != nil {
-		return fmt.Errorf("error in combining masks [%v]: %w", prefix, err)
+	if err := combineMasks(ctx, manifest); err != nil {
+		return fmt.Errorf("error in combining masks [%v]: %w", manifest.Prefix, err)
 	}
 
 	return nil
 }
 
-func analyzeScreenshot(ssPath, maskPath string, db *sql.DB) error {
+func analyzeScreenshot(city string, cell *manifestCell, ssPath, maskPath string,
+	p *palette) (trafficCounts, []segmentCounts, error) {
+
 	pngData, err := os.ReadFile(ssPath)
 	if err != nil {
-		return fmt.Errorf("error in reading the screenshot file [%v]: %w", ssPath, err)
+		return trafficCounts{}, nil, fmt.Errorf("error in reading the screenshot file [%v]: %w", ssPath, err)
 	}
 
-	maskImg, err := computeMask(pngData)
+	maskImg, err := computeMask(pngData, p)
 	if err != nil {
-		return fmt.Errorf("error in computing mask for [%v]: %w", ssPath, err)
+		return trafficCounts{}, nil, fmt.Errorf("error in computing mask for [%v]: %w", ssPath, err)
 	}
 
 	if err := saveMaskImage(maskPath, maskImg); err != nil {
-		return fmt.Errorf("error in saving mask [%v]: %w", maskPath, err)
+		return trafficCounts{}, nil, fmt.Errorf("error in saving mask [%v]: %w", maskPath, err)
 	}
 
-	yellowCount, redCount, darkRedCount := computeTraffic(maskImg)
-	if err := insertTraffic(db, ssPath, yellowCount, redCount, darkRedCount); err != nil {
-		return fmt.Errorf("error in inserting traffic [%v]: %w", ssPath, err)
+	roadMask, err := updateRoadMask(city, cell.X, cell.Y, maskImg)
+	if err != nil {
+		return trafficCounts{}, nil, fmt.Errorf("error in updating road mask for [%v]: %w", ssPath, err)
 	}
+	counts := computeTraffic(maskImg)
+	counts.RoadPixels = countRoadPixels(roadMask)
 
-	return nil
+	segments, err := segmentMap(city, cell.X, cell.Y, roadMask)
+	if err != nil {
+		return trafficCounts{}, nil, fmt.Errorf("error in reading segment map for [%v]: %w", ssPath, err)
+	}
+	croppedMask := cropImage(maskImg)
+
+	return counts, countSegmentTraffic(croppedMask, croppedMask.Bounds().Min, segments), nil
 }
 
-func computeMask(pngFile []byte) (*image.Gray, error) {
+func computeMask(pngFile []byte, p *palette) (*image.Gray, error) {
 	img, _, err := image.Decode(bytes.NewReader(pngFile))
 	if err != nil {
 		return nil, fmt.Errorf("error decoding png image: %w", err)
 	}
 
-	mask := image.NewGray(img.Bounds())
-	for y := img.Bounds().Min.Y; y < img.Bounds().Max.Y; y++ {
-		for x := img.Bounds().Min.X; x < img.Bounds().Max.X; x++ {
-			r, g, b, _ := img.At(x, y).RGBA()
-			r8, g8, b8 := uint8(r>>8), uint8(g>>8), uint8(b>>8)
-			if colorClose(r8, g8, b8, baseDarkRed, threshold) {
-				mask.SetGray(x, y, color.Gray{darkRedValueInMask})
-			} else if colorClose(r8, g8, b8, baseRed, threshold) {
-				mask.SetGray(x, y, color.Gray{redValueInMask})
-			} else if colorClose(r8, g8, b8, baseYellow, threshold) {
-				mask.SetGray(x, y, color.Gray{yellowValueInMask})
-			} else {
-				mask.SetGray(x, y, color.Gray{0})
+	return maskImage(img, p.lookupTable()), nil
+}
+
+// maskImage sets every pixel of the mask to the value of the color of the image in the lookup table.
+func maskImage(img image.Image, lut []uint8) *image.Gray {
+	bounds := img.Bounds()
+	mask := image.NewGray(bounds)
+
+	// fast paths work directly on the pixels, avoiding an interface call per pixel
+	switch src := img.(type) {
+	case *image.RGBA:
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			pix := src.Pix[src.PixOffset(bounds.Min.X, y):]
+			maskPix := mask.Pix[mask.PixOffset(bounds.Min.X, y):]
+			for i := range bounds.Dx() {
+				// premultiplied already, same as what RGBA() returns
+				maskPix[i] = lut[lutIndex(pix[4*i], pix[4*i+1], pix[4*i+2])]
+			}
+		}
+
+	case *image.NRGBA:
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			pix := src.Pix[src.PixOffset(bounds.Min.X, y):]
+			maskPix := mask.Pix[mask.PixOffset(bounds.Min.X, y):]
+			for i := range bounds.Dx() {
+				r, g, b, a := pix[4*i], pix[4*i+1], pix[4*i+2], pix[4*i+3]
+				if a != 0xff {
+					r, g, b = premultiply(r, a), premultiply(g, a), premultiply(b, a)
+				}
+				maskPix[i] = lut[lutIndex(r, g, b)]
+			}
+		}
+
+	case *image.Paletted:
+		paletteLUT := make([]uint8, len(src.Palette))
+		for i, c := range src.Palette {
+			r, g, b, _ := c.RGBA()
+			paletteLUT[i] = lut[lutIndex(uint8(r>>8), uint8(g>>8), uint8(b>>8))]
+		}
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			pix := src.Pix[src.PixOffset(bounds.Min.X, y):]
+			maskPix := mask.Pix[mask.PixOffset(bounds.Min.X, y):]
+			for i := range bounds.Dx() {
+				maskPix[i] = paletteLUT[pix[i]]
 			}
 		}
+
+	default:
+		return maskImageGeneric(img, lut)
 	}
 
-	return mask, nil
+	return mask
+}
+
+// maskImageGeneric works on any image, with an interface call per pixel.
+func maskImageGeneric(img image.Image, lut []uint8) *image.Gray {
+	bounds := img.Bounds()
+	mask := image.NewGray(bounds)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			r, g, b, _ := img.At(x, y).RGBA()
+			mask.SetGray(x, y, color.Gray{lut[lutIndex(uint8(r>>8), uint8(g>>8), uint8(b>>8))]})
+		}
+	}
+	return mask
+}
+
+// premultiply matches the conversion done by color.NRGBA.RGBA() truncated to 8 bits.
+func premultiply(c, a uint8) uint8 {
+	v := uint32(c) | uint32(c)<<8
+	v = v * (uint32(a) | uint32(a)<<8) / 0xffff
+	return uint8(v >> 8)
 }
 
 func saveMaskImage(maskPath string, mask *image.Gray) error {
@@ -134,37 +256,30 @@ func saveMaskImage(maskPath string, mask *image.Gray) error {
 	return nil
 }
 
-func colorClose(r, g, b uint8, target color.RGBA, threshold uint8) bool {
-	return absdiff(r, target.R) <= threshold &&
-		absdiff(g, target.G) <= threshold &&
-		absdiff(b, target.B) <= threshold
-}
-
-func absdiff(a, b uint8) uint8 {
-	if a > b {
-		return a - b
-	}
-	return b - a
+func computeTraffic(img *image.Gray) trafficCounts {
+	croppedImg := cropImage(img)
+	return countTraffic(croppedImg, croppedImg.Bounds())
 }
 
-func computeTraffic(img *image.Gray) (int, int, int) {
-	croppedImg := cropImage(img)
+// countTraffic counts the pixels of each traffic class of the mask within the rect.
+func countTraffic(mask *image.Gray, rect image.Rectangle) trafficCounts {
+	rect = rect.Intersect(mask.Bounds())
 
-	yellowCount := 0
-	redCount := 0
-	darkRedCount := 0
-	for x := range croppedImg.Bounds().Dx() {
-		for y := range croppedImg.Bounds().Dy() {
-			gray := croppedImg.GrayAt(x, y).Y
+	var counts trafficCounts
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		for x := rect.Min.X; x < rect.Max.X; x++ {
+			gray := mask.GrayAt(x, y).Y
 			switch gray {
+			case greenValueInMask:
+				counts.Green++
 			case yellowValueInMask:
-				yellowCount++
+				counts.Yellow++
 			case redValueInMask:
-				redCount++
+				counts.Red++
 			case darkRedValueInMask:
-				darkRedCount++
+				counts.DarkRed++
 			}
 		}
 	}
-	return yellowCount, redCount, darkRedCount
+	return counts
 }
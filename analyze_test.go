@@ -0,0 +1,203 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"math/rand/v2"
+	"testing"
+)
+
+// newTestMask returns a full size mask with a pixel of every traffic class inside the
+// cropped region, at its corners, and the same pixels in the UI left out around it.
+func newTestMask() *image.Gray {
+	mask := image.NewGray(image.Rect(0, 0, imageWidth, imageHeight))
+
+	// inside the cropped region, at its corners
+	mask.SetGray(imageToLeaveOnLeft, imageToLeaveOnTop, color.Gray{greenValueInMask})
+	mask.SetGray(imageWidth-imageToLeaveOnRight-1, imageToLeaveOnTop, color.Gray{yellowValueInMask})
+	mask.SetGray(imageToLeaveOnLeft, imageHeight-imageToLeaveOnBottom-1, color.Gray{redValueInMask})
+	mask.SetGray(imageWidth-imageToLeaveOnRight-1, imageHeight-imageToLeaveOnBottom-1, color.Gray{darkRedValueInMask})
+	mask.SetGray(imageToLeaveOnLeft+10, imageToLeaveOnTop+10, color.Gray{darkRedValueInMask})
+
+	// in the UI left out, just outside of each edge of the cropped region
+	mask.SetGray(imageToLeaveOnLeft-1, imageToLeaveOnTop, color.Gray{greenValueInMask})
+	mask.SetGray(imageToLeaveOnLeft, imageToLeaveOnTop-1, color.Gray{yellowValueInMask})
+	mask.SetGray(imageWidth-imageToLeaveOnRight, imageToLeaveOnTop, color.Gray{redValueInMask})
+	mask.SetGray(imageToLeaveOnLeft, imageHeight-imageToLeaveOnBottom, color.Gray{darkRedValueInMask})
+
+	// in the top left region, which was counted before the crop was honoured
+	mask.SetGray(0, 0, color.Gray{darkRedValueInMask})
+	mask.SetGray(10, 10, color.Gray{redValueInMask})
+	return mask
+}
+
+func TestCropImage(t *testing.T) {
+	cropped := cropImage(newTestMask())
+
+	want := image.Rect(imageToLeaveOnLeft, imageToLeaveOnTop,
+		imageToLeaveOnLeft+imageWidthWithLeaveOuts, imageToLeaveOnTop+imageHeightWithLeaveOuts)
+	if cropped.Bounds() != want {
+		t.Fatalf("bounds of cropped image are %v, want %v", cropped.Bounds(), want)
+	}
+	if got := cropped.GrayAt(imageToLeaveOnLeft, imageToLeaveOnTop).Y; got != greenValueInMask {
+		t.Errorf("top left pixel of cropped image is %v, want %v", got, greenValueInMask)
+	}
+	if got := cropped.GrayAt(imageToLeaveOnLeft-1, imageToLeaveOnTop).Y; got != 0 {
+		t.Errorf("pixel outside of cropped image is %v, want 0", got)
+	}
+}
+
+func TestComputeTraffic(t *testing.T) {
+	got := computeTraffic(newTestMask())
+	want := trafficCounts{Green: 1, Yellow: 1, Red: 1, DarkRed: 2}
+	if got != want {
+		t.Errorf("computeTraffic() = %+v, want %+v", got, want)
+	}
+}
+
+func TestCountTraffic(t *testing.T) {
+	mask := newTestMask()
+	tests := []struct {
+		name string
+		rect image.Rectangle
+		want trafficCounts
+	}{
+		{
+			name: "whole image",
+			rect: mask.Bounds(),
+			want: trafficCounts{Green: 2, Yellow: 2, Red: 3, DarkRed: 4},
+		},
+		{
+			name: "top left region",
+			rect: image.Rect(0, 0, imageWidthWithLeaveOuts, imageHeightWithLeaveOuts),
+			want: trafficCounts{Green: 2, Yellow: 1, Red: 1, DarkRed: 2},
+		},
+		{
+			name: "rect beyond the image",
+			rect: image.Rect(-100, -100, 11, 11),
+			want: trafficCounts{Red: 1, DarkRed: 1},
+		},
+		{
+			name: "empty rect",
+			rect: image.Rect(20, 20, 20, 20),
+			want: trafficCounts{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := countTraffic(mask, tt.rect); got != tt.want {
+				t.Errorf("countTraffic(%v) = %+v, want %+v", tt.rect, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCountTrafficOfCombinedMask(t *testing.T) {
+	// a cell of a combined mask is at its position in the grid, not at the origin
+	combined := image.NewGray(image.Rect(0, 0, 2*imageWidthWithLeaveOuts, imageHeightWithLeaveOuts))
+	cropped := cropImage(newTestMask())
+	for y := cropped.Bounds().Min.Y; y < cropped.Bounds().Max.Y; y++ {
+		for x := cropped.Bounds().Min.X; x < cropped.Bounds().Max.X; x++ {
+			combined.SetGray(x-imageToLeaveOnLeft+imageWidthWithLeaveOuts, y-imageToLeaveOnTop, cropped.GrayAt(x, y))
+		}
+	}
+
+	rect := image.Rect(imageWidthWithLeaveOuts, 0, 2*imageWidthWithLeaveOuts, imageHeightWithLeaveOuts)
+	want := trafficCounts{Green: 1, Yellow: 1, Red: 1, DarkRed: 2}
+	if got := countTraffic(combined, rect); got != want {
+		t.Errorf("countTraffic() of second cell = %+v, want %+v", got, want)
+	}
+	if got := countTraffic(combined, image.Rect(0, 0, imageWidthWithLeaveOuts, imageHeightWithLeaveOuts)); got != (trafficCounts{}) {
+		t.Errorf("countTraffic() of first cell = %+v, want none", got)
+	}
+}
+
+// newTestImages returns a screenshot sized image of each type with a fast path in
+// maskImage, with pixels of the base colors, colors close to them and random colors,
+// some of them translucent.
+func newTestImages() map[string]image.Image {
+	rng := rand.New(rand.NewPCG(1, 2))
+	colors := []color.NRGBA{{A: 0xff}, {R: 0xff, G: 0xff, B: 0xff, A: 0xff}}
+	for _, base := range []color.RGBA{baseDarkRed, baseRed, baseYellow, baseGreen} {
+		for _, a := range []uint8{0xff, 0xf0, 0x80, 0} {
+			colors = append(colors, color.NRGBA{base.R, base.G, base.B, a},
+				color.NRGBA{base.R + 3, base.G - 2, base.B + 1, a})
+		}
+	}
+	for range 200 {
+		colors = append(colors, color.NRGBA{uint8(rng.IntN(256)), uint8(rng.IntN(256)), uint8(rng.IntN(256)), 0xff})
+	}
+
+	bounds := image.Rect(0, 0, imageWidth, imageHeight)
+	rgba := image.NewRGBA(bounds)
+	nrgba := image.NewNRGBA(bounds)
+	paletted := image.NewPaletted(bounds, nil)
+	for _, c := range colors {
+		paletted.Palette = append(paletted.Palette, c)
+	}
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			i := rng.IntN(len(colors))
+			rgba.Set(x, y, colors[i])
+			nrgba.SetNRGBA(x, y, colors[i])
+			paletted.SetColorIndex(x, y, uint8(i))
+		}
+	}
+
+	return map[string]image.Image{"rgba": rgba, "nrgba": nrgba, "paletted": paletted}
+}
+
+func testLookupTable(t testing.TB) []uint8 {
+	p, err := newPalette(defaultPaletteConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p.lookupTable()
+}
+
+func TestMaskImageFastPaths(t *testing.T) {
+	lut := testLookupTable(t)
+	crop := image.Rect(imageToLeaveOnLeft, imageToLeaveOnTop, imageWidth-imageToLeaveOnRight,
+		imageHeight-imageToLeaveOnBottom)
+
+	for name, img := range newTestImages() {
+		t.Run(name, func(t *testing.T) {
+			// a sub image has its pixels away from the start of Pix
+			subImage := img.(interface {
+				SubImage(image.Rectangle) image.Image
+			}).SubImage(crop)
+
+			for _, img := range []image.Image{img, subImage} {
+				got, want := maskImage(img, lut), maskImageGeneric(img, lut)
+				if got.Bounds() != want.Bounds() {
+					t.Fatalf("bounds of mask are %v, want %v", got.Bounds(), want.Bounds())
+				}
+				for y := want.Bounds().Min.Y; y < want.Bounds().Max.Y; y++ {
+					for x := want.Bounds().Min.X; x < want.Bounds().Max.X; x++ {
+						if got.GrayAt(x, y) != want.GrayAt(x, y) {
+							t.Fatalf("mask at (%v, %v) is %v, want %v for color %v", x, y,
+								got.GrayAt(x, y).Y, want.GrayAt(x, y).Y, img.At(x, y))
+						}
+					}
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkComputeMask(b *testing.B) {
+	lut := testLookupTable(b)
+	for name, img := range newTestImages() {
+		b.Run(name, func(b *testing.B) {
+			for b.Loop() {
+				maskImage(img, lut)
+			}
+		})
+		b.Run(name+"/generic", func(b *testing.B) {
+			for b.Loop() {
+				maskImageGeneric(img, lut)
+			}
+		})
+	}
+}
@@ -0,0 +1,407 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultAPILimit = 100
+	maxAPILimit     = 1000
+	// the most congested cells listed in the summary of a round
+	summaryTopCells = 10
+
+	apiRoundsSQL = `SELECT prefix, city, ts, status, coverage, captured, skipped, failed, interval_minutes, excluded FROM capture_round
+		WHERE city = ? AND ts >= ? AND ts < ? ORDER BY ts DESC LIMIT ? OFFSET ?`
+	apiRoundSQL = `SELECT prefix, city, ts, status, coverage, captured, skipped, failed, interval_minutes, excluded FROM capture_round
+		WHERE prefix = ?`
+	apiCellTrafficSQL = `SELECT ts, 1, green, yellow, red, dark_red, congestion, road_pixels FROM traffic
+		WHERE city = ? AND x = ? AND y = ? AND ts >= ? AND ts < ? ORDER BY ts LIMIT ? OFFSET ?`
+	// ts is local time, treating it as UTC keeps the buckets aligned to the local hours and days
+	apiCellTrafficBucketSQL = `SELECT datetime((CAST(strftime('%s', ts) AS INTEGER) / ?) * ?, 'unixepoch') AS bucket,
+		COUNT(*), AVG(green), AVG(yellow), AVG(red), AVG(dark_red), AVG(congestion), AVG(road_pixels) FROM traffic
+		WHERE city = ? AND x = ? AND y = ? AND ts >= ? AND ts < ? GROUP BY bucket ORDER BY bucket LIMIT ? OFFSET ?`
+	apiRoundSummarySQL = `SELECT COUNT(*), SUM(green), SUM(yellow), SUM(red), SUM(dark_red), AVG(congestion)
+		FROM traffic WHERE ss_path >= ? AND ss_path < ?`
+	apiRoundTopCellsSQL = `SELECT x, y, congestion FROM traffic WHERE ss_path >= ? AND ss_path < ?
+		ORDER BY congestion DESC LIMIT ?`
+)
+
+// apiItem is an item of an API response, which is encoded as JSON or as a CSV row.
+type apiItem interface {
+	csvHeader() []string
+	csvRecord() []string
+}
+
+// apiPage is the JSON response of a paginated list, the next page is also in the Link header.
+type apiPage[T apiItem] struct {
+	Data       []T  `json:"data"`
+	NextOffset *int `json:"next_offset,omitempty"`
+}
+
+type apiRound struct {
+	Prefix   string  `json:"prefix"`
+	City     string  `json:"city"`
+	Ts       string  `json:"ts"`
+	Status   string  `json:"status"`
+	Coverage float64 `json:"coverage"`
+	Captured int     `json:"captured"`
+	Skipped  int     `json:"skipped"`
+	Failed   int     `json:"failed"`
+	// minutes until the next round as chosen by the cadence, null for older rounds
+	IntervalMinutes *int `json:"interval_minutes"`
+	// cells left out of the round as they never have any road, null for older rounds
+	Excluded *int `json:"excluded"`
+}
+
+func (r apiRound) csvHeader() []string {
+	return []string{"prefix", "city", "ts", "status", "coverage", "captured", "skipped", "failed", "interval_minutes", "excluded"}
+}
+
+func (r apiRound) csvRecord() []string {
+	return []string{r.Prefix, r.City, r.Ts, r.Status, formatFloat(r.Coverage),
+		strconv.Itoa(r.Captured), strconv.Itoa(r.Skipped), strconv.Itoa(r.Failed), formatNullInt(r.IntervalMinutes),
+		formatNullInt(r.Excluded)}
+}
+
+// apiTraffic is the traffic of a cell in a round, or averaged over the rounds in a bucket.
+type apiTraffic struct {
+	Ts         string   `json:"ts"`
+	Rounds     int      `json:"rounds"`
+	Green      *float64 `json:"green"`
+	Yellow     float64  `json:"yellow"`
+	Red        float64  `json:"red"`
+	DarkRed    float64  `json:"dark_red"`
+	Congestion *float64 `json:"congestion"`
+	RoadPixels *float64 `json:"road_pixels"`
+}
+
+func (t apiTraffic) csvHeader() []string {
+	return []string{"ts", "rounds", "green", "yellow", "red", "dark_red", "congestion", "road_pixels"}
+}
+
+func (t apiTraffic) csvRecord() []string {
+	return []string{t.Ts, strconv.Itoa(t.Rounds), formatNullFloat(t.Green), formatFloat(t.Yellow),
+		formatFloat(t.Red), formatFloat(t.DarkRed), formatNullFloat(t.Congestion), formatNullFloat(t.RoadPixels)}
+}
+
+type apiRoundSummary struct {
+	apiRound
+	Cells          int              `json:"cells"`
+	Green          int              `json:"green"`
+	Yellow         int              `json:"yellow"`
+	Red            int              `json:"red"`
+	DarkRed        int              `json:"dark_red"`
+	Congestion     float64          `json:"congestion"`
+	MeanCongestion *float64         `json:"mean_congestion"`
+	TopCells       []apiCongestedXY `json:"top_cells"`
+}
+
+type apiCongestedXY struct {
+	X          int     `json:"x"`
+	Y          int     `json:"y"`
+	Congestion float64 `json:"congestion"`
+}
+
+// csvHeader leaves out the top cells, which are only in the JSON response.
+func (s apiRoundSummary) csvHeader() []string {
+	return append(s.apiRound.csvHeader(), "cells", "green", "yellow", "red", "dark_red", "congestion", "mean_congestion")
+}
+
+func (s apiRoundSummary) csvRecord() []string {
+	return append(s.apiRound.csvRecord(), strconv.Itoa(s.Cells), strconv.Itoa(s.Green), strconv.Itoa(s.Yellow),
+		strconv.Itoa(s.Red), strconv.Itoa(s.DarkRed), formatFloat(s.Congestion), formatNullFloat(s.MeanCongestion))
+}
+
+func (s *dashboardServer) registerAPI(mux *http.ServeMux) {
+	mux.HandleFunc("GET /api/v1/rounds", s.handleAPIRounds)
+	mux.HandleFunc("GET /api/v1/rounds/{prefix}/summary", s.handleAPIRoundSummary)
+	mux.HandleFunc("GET /api/v1/cells/{x}/{y}/traffic", s.handleAPICellTraffic)
+}
+
+// handleAPIRounds lists the capture rounds of the city in the time range, latest first.
+func (s *dashboardServer) handleAPIRounds(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	city, err := s.city(query.Get("city"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	from, to, err := apiTimeRange(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	limit, offset, err := apiPagination(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// one more row than the limit tells if there is a next page
+	rows, err := s.db.QueryContext(r.Context(), apiRoundsSQL, city.Name, from, to, limit+1, offset)
+	if err != nil {
+		serverError(w, fmt.Errorf("error in querying rounds: %w", err))
+		return
+	}
+	defer closeRows(rows)
+
+	rounds := []apiRound{}
+	for rows.Next() {
+		var round apiRound
+		if err := rows.Scan(&round.Prefix, &round.City, &round.Ts, &round.Status, &round.Coverage,
+			&round.Captured, &round.Skipped, &round.Failed, &round.IntervalMinutes, &round.Excluded); err != nil {
+			serverError(w, fmt.Errorf("error scanning sqlite row: %w", err))
+			return
+		}
+		rounds = append(rounds, round)
+	}
+	if err := rows.Err(); err != nil {
+		serverError(w, fmt.Errorf("sqlite rows iteration error: %w", err))
+		return
+	}
+
+	writeAPIPage(w, r, rounds, limit, offset)
+}
+
+// handleAPICellTraffic returns the traffic of the cell in the time range, each round or
+// averaged over buckets of the given duration, e.g. 15m, 1h or 24h, if bucket is set.
+func (s *dashboardServer) handleAPICellTraffic(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	city, err := s.city(query.Get("city"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	x, errX := strconv.Atoi(r.PathValue("x"))
+	y, errY := strconv.Atoi(r.PathValue("y"))
+	if errX != nil || errY != nil {
+		http.Error(w, "x and y must be integers", http.StatusBadRequest)
+		return
+	}
+	from, to, err := apiTimeRange(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	limit, offset, err := apiPagination(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var rows *sql.Rows
+	if bucket := query.Get("bucket"); bucket != "" {
+		d, err := time.ParseDuration(bucket)
+		if err != nil || d < time.Minute || d%time.Second != 0 {
+			http.Error(w, "bucket must be a duration of at least a minute e.g. 15m, 1h or 24h", http.StatusBadRequest)
+			return
+		}
+		seconds := int64(d / time.Second)
+		rows, err = s.db.QueryContext(r.Context(), apiCellTrafficBucketSQL, seconds, seconds,
+			city.Name, x, y, from, to, limit+1, offset)
+		if err != nil {
+			serverError(w, fmt.Errorf("error in querying traffic of cell: %w", err))
+			return
+		}
+	} else {
+		rows, err = s.db.QueryContext(r.Context(), apiCellTrafficSQL, city.Name, x, y, from, to, limit+1, offset)
+		if err != nil {
+			serverError(w, fmt.Errorf("error in querying traffic of cell: %w", err))
+			return
+		}
+	}
+	defer closeRows(rows)
+
+	traffic := []apiTraffic{}
+	for rows.Next() {
+		var t apiTraffic
+		if err := rows.Scan(&t.Ts, &t.Rounds, &t.Green, &t.Yellow, &t.Red, &t.DarkRed,
+			&t.Congestion, &t.RoadPixels); err != nil {
+			serverError(w, fmt.Errorf("error scanning sqlite row: %w", err))
+			return
+		}
+		traffic = append(traffic, t)
+	}
+	if err := rows.Err(); err != nil {
+		serverError(w, fmt.Errorf("sqlite rows iteration error: %w", err))
+		return
+	}
+
+	writeAPIPage(w, r, traffic, limit, offset)
+}
+
+// handleAPIRoundSummary returns the outcome of the round with the traffic summed over the
+// cells, the congestion of the summed traffic, and the most congested cells.
+func (s *dashboardServer) handleAPIRoundSummary(w http.ResponseWriter, r *http.Request) {
+	prefix := r.PathValue("prefix")
+
+	var summary apiRoundSummary
+	round := &summary.apiRound
+	if err := s.db.QueryRowContext(r.Context(), apiRoundSQL, prefix).Scan(&round.Prefix, &round.City, &round.Ts,
+		&round.Status, &round.Coverage, &round.Captured, &round.Skipped, &round.Failed,
+		&round.IntervalMinutes, &round.Excluded); errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, fmt.Sprintf("unknown round [%v]", prefix), http.StatusNotFound)
+		return
+	} else if err != nil {
+		serverError(w, fmt.Errorf("error in querying round [%v]: %w", prefix, err))
+		return
+	}
+
+	from, to := roundCellRange(prefix)
+	var green, yellow, red, darkRed sql.NullInt64
+	if err := s.db.QueryRowContext(r.Context(), apiRoundSummarySQL, from, to).Scan(
+		&summary.Cells, &green, &yellow, &red, &darkRed, &summary.MeanCongestion); err != nil {
+		serverError(w, fmt.Errorf("error in summarizing round [%v]: %w", prefix, err))
+		return
+	}
+	counts := trafficCounts{Green: int(green.Int64), Yellow: int(yellow.Int64), Red: int(red.Int64),
+		DarkRed: int(darkRed.Int64)}
+	summary.Green, summary.Yellow, summary.Red, summary.DarkRed = counts.Green, counts.Yellow, counts.Red, counts.DarkRed
+	summary.Congestion = counts.congestion()
+
+	rows, err := s.db.QueryContext(r.Context(), apiRoundTopCellsSQL, from, to, summaryTopCells)
+	if err != nil {
+		serverError(w, fmt.Errorf("error in querying top cells of round [%v]: %w", prefix, err))
+		return
+	}
+	defer closeRows(rows)
+
+	summary.TopCells = []apiCongestedXY{}
+	for rows.Next() {
+		var cell apiCongestedXY
+		var congestion sql.NullFloat64
+		if err := rows.Scan(&cell.X, &cell.Y, &congestion); err != nil {
+			serverError(w, fmt.Errorf("error scanning sqlite row: %w", err))
+			return
+		}
+		if !congestion.Valid {
+			continue
+		}
+		cell.Congestion = congestion.Float64
+		summary.TopCells = append(summary.TopCells, cell)
+	}
+	if err := rows.Err(); err != nil {
+		serverError(w, fmt.Errorf("sqlite rows iteration error: %w", err))
+		return
+	}
+
+	if wantsCSV(r) {
+		writeCSV(w, []apiRoundSummary{summary})
+		return
+	}
+	writeJSON(w, summary)
+}
+
+// apiTimeRange returns the [from, to) time range of the query in the format of the ts
+// columns, from defaults to the beginning of time and to defaults to now.
+func apiTimeRange(query url.Values) (string, string, error) {
+	from, err := parseExportTime(query.Get("from"), time.Time{})
+	if err != nil {
+		return "", "", err
+	}
+	to, err := parseExportTime(query.Get("to"), time.Now())
+	if err != nil {
+		return "", "", err
+	}
+	return from.Format(time.DateTime), to.Format(time.DateTime), nil
+}
+
+func apiPagination(query url.Values) (int, int, error) {
+	limit, offset := defaultAPILimit, 0
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > maxAPILimit {
+			return 0, 0, fmt.Errorf("limit must be between 1 and %v", maxAPILimit)
+		}
+		limit = n
+	}
+	if v := query.Get("offset"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return 0, 0, fmt.Errorf("offset must be a non negative integer")
+		}
+		offset = n
+	}
+	return limit, offset, nil
+}
+
+// writeAPIPage writes the items fetched with one more than the limit, the extra
+// item is dropped and tells that there is a next page.
+func writeAPIPage[T apiItem](w http.ResponseWriter, r *http.Request, items []T, limit, offset int) {
+	page := apiPage[T]{Data: items}
+	if len(items) > limit {
+		page.Data = items[:limit]
+		next := offset + limit
+		page.NextOffset = &next
+
+		nextURL := *r.URL
+		query := nextURL.Query()
+		query.Set("offset", strconv.Itoa(next))
+		query.Set("limit", strconv.Itoa(limit))
+		nextURL.RawQuery = query.Encode()
+		w.Header().Set("Link", fmt.Sprintf("<%v>; rel=\"next\"", nextURL.RequestURI()))
+	}
+
+	if wantsCSV(r) {
+		writeCSV(w, page.Data)
+		return
+	}
+	writeJSON(w, page)
+}
+
+// wantsCSV tells if the client asked for CSV with ?format=csv or the Accept header.
+func wantsCSV(r *http.Request) bool {
+	if format := r.URL.Query().Get("format"); format != "" {
+		return format == "csv"
+	}
+	return strings.Contains(r.Header.Get("Accept"), "text/csv")
+}
+
+func writeCSV[T apiItem](w http.ResponseWriter, items []T) {
+	w.Header().Set("Content-Type", "text/csv")
+	cw := csv.NewWriter(w)
+
+	var zero T
+	if err := cw.Write(zero.csvHeader()); err != nil {
+		log.Printf("error in writing response: %v", err)
+		return
+	}
+	for _, item := range items {
+		if err := cw.Write(item.csvRecord()); err != nil {
+			log.Printf("error in writing response: %v", err)
+			return
+		}
+	}
+
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		log.Printf("error in writing response: %v", err)
+	}
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+func formatNullFloat(v *float64) string {
+	if v == nil {
+		return ""
+	}
+	return formatFloat(*v)
+}
+
+func formatNullInt(v *int) string {
+	if v == nil {
+		return ""
+	}
+	return strconv.Itoa(*v)
+}
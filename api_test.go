@@ -0,0 +1,217 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"image"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestAPI returns the handler of the dashboard with the rounds of jaipur captured at the times.
+func newTestAPI(t *testing.T, times ...time.Time) (*sql.DB, http.Handler) {
+	t.Helper()
+	db := newTestDB(t)
+	city := defaultConfig().Cities[0]
+	for _, ts := range times {
+		prefix := ts.Format("20060102-150405") + "-" + city.Name
+		if _, err := db.Exec(insertCaptureRoundSQL, prefix, city.Name, ts.Format(time.DateTime), roundStatusComplete,
+			1.0, 2, 0, 0, nil, nil); err != nil {
+			t.Fatal(err)
+		}
+		insertTestRound(t, db, ts, map[image.Point]trafficCounts{
+			{0, 0}: {Green: 100},
+			{1, 0}: {Green: 50, Yellow: 30, Red: 20},
+		})
+	}
+	return db, newDashboardServer(db, []*cityConfig{city}, defaultHealthConfig()).handler()
+}
+
+func getAPI(t *testing.T, handler http.Handler, target string, header http.Header) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, target, nil)
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec
+}
+
+func decodeAPI(t *testing.T, rec *httptest.ResponseRecorder, v any) {
+	t.Helper()
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %v, want %v: %v", rec.Code, http.StatusOK, rec.Body.String())
+	}
+	if err := json.NewDecoder(rec.Body).Decode(v); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAPIRoundsPagination(t *testing.T) {
+	start := time.Date(2025, 1, 2, 10, 0, 0, 0, time.UTC)
+	_, handler := newTestAPI(t, start, start.Add(10*time.Minute), start.Add(20*time.Minute))
+
+	var page apiPage[apiRound]
+	rec := getAPI(t, handler, "/api/v1/rounds?limit=2", nil)
+	link := rec.Header().Get("Link")
+	decodeAPI(t, rec, &page)
+	if len(page.Data) != 2 || page.Data[0].Ts != "2025-01-02 10:20:00" {
+		t.Fatalf("first page = %+v, want the latest 2 rounds", page.Data)
+	}
+	if page.NextOffset == nil || *page.NextOffset != 2 {
+		t.Errorf("next offset = %v, want 2", page.NextOffset)
+	}
+	if want := `</api/v1/rounds?limit=2&offset=2>; rel="next"`; link != want {
+		t.Errorf("link = %v, want %v", link, want)
+	}
+
+	page = apiPage[apiRound]{}
+	rec = getAPI(t, handler, "/api/v1/rounds?limit=2&offset=2", nil)
+	link = rec.Header().Get("Link")
+	decodeAPI(t, rec, &page)
+	if len(page.Data) != 1 || page.Data[0].Ts != "2025-01-02 10:00:00" {
+		t.Errorf("last page = %+v, want the first round", page.Data)
+	}
+	if page.NextOffset != nil || link != "" {
+		t.Errorf("last page has next offset %v and link [%v], want none", page.NextOffset, link)
+	}
+
+	// exactly the limit has no next page
+	page = apiPage[apiRound]{}
+	rec = getAPI(t, handler, "/api/v1/rounds?limit=3", nil)
+	decodeAPI(t, rec, &page)
+	if len(page.Data) != 3 || page.NextOffset != nil {
+		t.Errorf("page of the limit has %v rounds and next offset %v, want 3 and none", len(page.Data), page.NextOffset)
+	}
+}
+
+func TestAPIRoundSummary(t *testing.T) {
+	ts := time.Date(2025, 1, 2, 10, 0, 0, 0, time.UTC)
+	db, handler := newTestAPI(t, ts)
+	// a cell of another city with the same time is not a cell of the round
+	if err := insertTraffic(t.Context(), db, "jaipur2", "20250102-100000-jaipur2-x0-y0.png",
+		trafficCounts{DarkRed: 100}); err != nil {
+		t.Fatal(err)
+	}
+
+	var summary apiRoundSummary
+	decodeAPI(t, getAPI(t, handler, "/api/v1/rounds/20250102-100000-jaipur/summary", nil), &summary)
+	if summary.Cells != 2 || summary.Green != 150 || summary.Yellow != 30 || summary.Red != 20 || summary.DarkRed != 0 {
+		t.Errorf("summary = %+v, want the traffic of the 2 cells of the round", summary)
+	}
+	if len(summary.TopCells) != 2 || summary.TopCells[0].X != 1 {
+		t.Errorf("top cells = %+v, want the cell [1, 0] first", summary.TopCells)
+	}
+
+	rec := getAPI(t, handler, "/api/v1/rounds/20250102-100000-jaipur/summary?format=csv", nil)
+	records, err := csv.NewReader(rec.Body).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 || len(records[0]) != len(records[1]) || records[1][0] != "20250102-100000-jaipur" {
+		t.Errorf("csv summary = %v, want the header and the round", records)
+	}
+}
+
+func TestAPICellTraffic(t *testing.T) {
+	start := time.Date(2025, 1, 2, 10, 0, 0, 0, time.UTC)
+	_, handler := newTestAPI(t, start.Add(5*time.Minute), start.Add(20*time.Minute), start.Add(70*time.Minute))
+
+	var page apiPage[apiTraffic]
+	decodeAPI(t, getAPI(t, handler, "/api/v1/cells/1/0/traffic", nil), &page)
+	if len(page.Data) != 3 || page.Data[0].Ts != "2025-01-02 10:05:00" || page.Data[0].Rounds != 1 {
+		t.Errorf("traffic = %+v, want each of the 3 rounds", page.Data)
+	}
+
+	page = apiPage[apiTraffic]{}
+	decodeAPI(t, getAPI(t, handler, "/api/v1/cells/1/0/traffic?bucket=1h", nil), &page)
+	if len(page.Data) != 2 {
+		t.Fatalf("hourly traffic = %+v, want 2 buckets", page.Data)
+	}
+	for i, want := range []struct {
+		ts     string
+		rounds int
+	}{{"2025-01-02 10:00:00", 2}, {"2025-01-02 11:00:00", 1}} {
+		if got := page.Data[i]; got.Ts != want.ts || got.Rounds != want.rounds || got.Yellow != 30 {
+			t.Errorf("bucket %v = %+v, want %v with %v rounds", i, got, want.ts, want.rounds)
+		}
+	}
+
+	page = apiPage[apiTraffic]{}
+	decodeAPI(t, getAPI(t, handler, "/api/v1/cells/1/0/traffic?from=2025-01-02+10:10:00&to=2025-01-02T11:00:00", nil), &page)
+	if len(page.Data) != 1 || page.Data[0].Ts != "2025-01-02 10:20:00" {
+		t.Errorf("traffic in the time range = %+v, want the round at 10:20", page.Data)
+	}
+}
+
+func TestAPICSVNegotiation(t *testing.T) {
+	_, handler := newTestAPI(t, time.Date(2025, 1, 2, 10, 0, 0, 0, time.UTC))
+
+	tests := []struct {
+		name    string
+		target  string
+		accept  string
+		wantCSV bool
+	}{
+		{name: "json by default", target: "/api/v1/cells/0/0/traffic"},
+		{name: "accept header", target: "/api/v1/cells/0/0/traffic", accept: "text/csv", wantCSV: true},
+		{name: "format query", target: "/api/v1/cells/0/0/traffic?format=csv", wantCSV: true},
+		{name: "format query over the accept header", target: "/api/v1/cells/0/0/traffic?format=json", accept: "text/csv"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := getAPI(t, handler, tt.target, http.Header{"Accept": {tt.accept}})
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %v, want %v", rec.Code, http.StatusOK)
+			}
+			contentType := rec.Header().Get("Content-Type")
+			if isCSV := contentType == "text/csv"; isCSV != tt.wantCSV {
+				t.Fatalf("content type = %v, want csv %v", contentType, tt.wantCSV)
+			}
+			if !tt.wantCSV {
+				return
+			}
+			records, err := csv.NewReader(rec.Body).ReadAll()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(records) != 2 || strings.Join(records[0], ",") != strings.Join(apiTraffic{}.csvHeader(), ",") {
+				t.Errorf("csv = %v, want the header and a row", records)
+			}
+		})
+	}
+}
+
+func TestAPIErrors(t *testing.T) {
+	_, handler := newTestAPI(t, time.Date(2025, 1, 2, 10, 0, 0, 0, time.UTC))
+
+	tests := []struct {
+		target string
+		status int
+	}{
+		{"/api/v1/rounds?city=unknown", http.StatusNotFound},
+		{"/api/v1/rounds?limit=0", http.StatusBadRequest},
+		{"/api/v1/rounds?limit=1001", http.StatusBadRequest},
+		{"/api/v1/rounds?limit=ten", http.StatusBadRequest},
+		{"/api/v1/rounds?offset=-1", http.StatusBadRequest},
+		{"/api/v1/rounds?from=yesterday", http.StatusBadRequest},
+		{"/api/v1/rounds/20250102-100500-jaipur/summary", http.StatusNotFound},
+		{"/api/v1/cells/0/0/traffic?city=unknown", http.StatusNotFound},
+		{"/api/v1/cells/a/0/traffic", http.StatusBadRequest},
+		{"/api/v1/cells/0/0/traffic?to=tomorrow", http.StatusBadRequest},
+		{"/api/v1/cells/0/0/traffic?bucket=30s", http.StatusBadRequest},
+		{"/api/v1/cells/0/0/traffic?bucket=hourly", http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		if rec := getAPI(t, handler, tt.target, nil); rec.Code != tt.status {
+			t.Errorf("%v has status %v, want %v", tt.target, rec.Code, tt.status)
+		}
+	}
+}
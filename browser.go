@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/go-rod/rod"
+	"github.com/go-rod/rod/lib/launcher"
+	"github.com/go-rod/rod/lib/proto"
+	"github.com/luabagg/orcgen/v2"
+)
+
+const (
+	defaultNumBrowsers    = maxRoutine
+	defaultBrowserMaxUses = 50
+
+	browserPageIdleTime = 2 * time.Second
+
+	// a browser that fails to launch is launched again after a backoff
+	minBrowserLaunchBackoff = time.Second
+	maxBrowserLaunchBackoff = time.Minute
+)
+
+// browserPool keeps a fixed number of headless browsers alive across the tiles
+// of a capture round. Each browser has a single page that is navigated from one
+// cell to the next, a browser is recycled after maxUses or when it fails. A slot
+// of the pool is launched when it is used, and it is not launched again until
+// the backoff after a failed launch has passed.
+type browserPool struct {
+	size     int
+	maxUses  int
+	browsers chan *pooledBrowser
+
+	closeOnce sync.Once
+}
+
+// pooledBrowser is a slot of the pool, the browser is nil until it is launched.
+type pooledBrowser struct {
+	id       int
+	launcher *launcher.Launcher
+	browser  *rod.Browser
+	page     *rod.Page
+	uses     int
+
+	failures     int
+	nextLaunchAt time.Time
+	launchErr    error
+}
+
+func newBrowserPool(size, maxUses int) *browserPool {
+	if size <= 0 {
+		size = defaultNumBrowsers
+	}
+	if maxUses <= 0 {
+		maxUses = defaultBrowserMaxUses
+	}
+
+	p := &browserPool{
+		size:     size,
+		maxUses:  maxUses,
+		browsers: make(chan *pooledBrowser, size),
+	}
+	for id := range size {
+		p.browsers <- &pooledBrowser{id: id}
+	}
+	return p
+}
+
+// launch starts the browser of the slot, cancelling the context stops waiting for it.
+func (b *pooledBrowser) launch(ctx context.Context) (err error) {
+	// rod panics in its Must* functions
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("error in launching browser [%v]: %v", b.id, r)
+		}
+	}()
+
+	// the context of the launcher only covers the launch, not the browser process
+	l := launcher.New().Context(ctx)
+	controlURL, err := l.Launch()
+	if err != nil {
+		l.Kill()
+		l.Cleanup()
+		return fmt.Errorf("error in launching browser [%v]: %w", b.id, err)
+	}
+
+	browser := rod.New().ControlURL(controlURL)
+	if err := browser.Connect(); err != nil {
+		l.Kill()
+		l.Cleanup()
+		return fmt.Errorf("error in connecting to browser [%v]: %w", b.id, err)
+	}
+
+	page, err := browser.Page(proto.TargetCreateTarget{})
+	if err != nil {
+		_ = browser.Close()
+		l.Kill()
+		l.Cleanup()
+		return fmt.Errorf("error in opening page in browser [%v]: %w", b.id, err)
+	}
+
+	b.launcher, b.browser, b.page, b.uses = l, browser, page, 0
+	log.Printf("launched browser [%v]", b.id)
+	return nil
+}
+
+// ensureLaunched launches the browser of the slot if it is not running. It fails
+// right away while the backoff after a failed launch has not passed.
+func (b *pooledBrowser) ensureLaunched(ctx context.Context) error {
+	if b.browser != nil {
+		return nil
+	}
+	if wait := time.Until(b.nextLaunchAt); wait > 0 {
+		return fmt.Errorf("browser [%v] is launched again in [%v] after error: %w",
+			b.id, wait.Round(time.Second), b.launchErr)
+	}
+
+	if err := b.launch(ctx); err != nil {
+		if ctx.Err() == nil {
+			b.failures++
+			b.launchErr = err
+			b.nextLaunchAt = time.Now().Add(min(minBrowserLaunchBackoff<<(b.failures-1), maxBrowserLaunchBackoff))
+		}
+		return err
+	}
+	b.failures = 0
+	return nil
+}
+
+// screenshot navigates a browser from the pool to the url, waits for the page
+// to be ready and captures it. It also returns the time taken to be ready.
+// Cancelling the context interrupts the navigation and the wait.
+func (p *browserPool) screenshot(ctx context.Context, url string, readiness readinessConfig) (
+	[]byte, time.Duration, error) {
+
+	var b *pooledBrowser
+	select {
+	case <-ctx.Done():
+		return nil, 0, ctx.Err()
+	case nb, ok := <-p.browsers:
+		if !ok {
+			return nil, 0, fmt.Errorf("browser pool is closed")
+		}
+		b = nb
+	}
+
+	if err := b.ensureLaunched(ctx); err != nil {
+		p.browsers <- b
+		return nil, 0, err
+	}
+
+	data, timeToReady, err := b.screenshot(ctx, url, readiness)
+	// a browser interrupted by the cancellation is not broken
+	p.release(b, err == nil || ctx.Err() != nil)
+	return data, timeToReady, err
+}
+
+func (b *pooledBrowser) screenshot(ctx context.Context, url string, readiness readinessConfig) (
+	data []byte, timeToReady time.Duration, err error) {
+
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("browser [%v] crashed: %v", b.id, r)
+		}
+	}()
+
+	b.uses++
+	page := b.page.Context(ctx)
+	start := time.Now()
+	if err := page.Navigate(url); err != nil {
+		return nil, 0, fmt.Errorf("error while loading the webpage: %w", err)
+	}
+
+	frame, err := b.waitReady(page, readiness)
+	timeToReady = time.Since(start)
+	if err != nil {
+		return nil, timeToReady, fmt.Errorf("page not ready after [%v]: %w", timeToReady, err)
+	}
+	if frame != nil {
+		return frame, timeToReady, nil
+	}
+
+	h := orcgen.NewHandler(orcgen.ScreenshotConfig{FromSurface: true})
+	fileInfo, err := h.GenerateFile(page)
+	if err != nil {
+		return nil, timeToReady, fmt.Errorf("error in taking screenshot: %w", err)
+	}
+	return fileInfo.File, timeToReady, nil
+}
+
+// waitReady blocks until the page is ready as per the readiness strategy.
+// The stable frames strategy also returns the last frame it captured.
+func (b *pooledBrowser) waitReady(page *rod.Page, readiness readinessConfig) ([]byte, error) {
+	timeout := time.Duration(readiness.TimeoutSeconds) * time.Second
+	page = page.Timeout(timeout)
+	defer page.CancelTimeout()
+
+	if err := page.WaitLoad(); err != nil {
+		return nil, fmt.Errorf("error in waiting for page load: %w", err)
+	}
+
+	switch readiness.Strategy {
+	case readinessSelector:
+		if _, err := page.Element(readiness.Selector); err != nil {
+			return nil, fmt.Errorf("error in waiting for [%v]: %w", readiness.Selector, err)
+		}
+		return nil, nil
+
+	case readinessStableFrames:
+		interval := time.Duration(readiness.FrameIntervalMillis) * time.Millisecond
+		var lastFrame []byte
+		stable := 0
+		for stable < readiness.StableFrames {
+			if lastFrame != nil {
+				select {
+				case <-page.GetContext().Done():
+					return nil, page.GetContext().Err()
+				case <-time.After(interval):
+				}
+			}
+
+			frame, err := page.Screenshot(false, &proto.PageCaptureScreenshot{
+				Format:      proto.PageCaptureScreenshotFormatPng,
+				FromSurface: true,
+			})
+			if err != nil {
+				return nil, fmt.Errorf("error in capturing frame: %w", err)
+			}
+
+			if bytes.Equal(frame, lastFrame) {
+				stable++
+			} else {
+				stable = 1
+			}
+			lastFrame = frame
+		}
+		return lastFrame, nil
+
+	default:
+		wait := page.WaitRequestIdle(browserPageIdleTime, nil, nil, nil)
+		wait()
+		return nil, nil
+	}
+}
+
+// release returns the browser to the pool, the browser is closed if it is worn
+// out or broken and is launched again when the slot is used next.
+func (p *browserPool) release(b *pooledBrowser, healthy bool) {
+	if !healthy || b.uses >= p.maxUses {
+		log.Printf("recycling browser [%v] after [%v] uses (healthy: %v)", b.id, b.uses, healthy)
+		b.close()
+	}
+	p.browsers <- b
+}
+
+func (b *pooledBrowser) close() {
+	if b.browser == nil {
+		return
+	}
+	if err := b.browser.Close(); err != nil {
+		log.Printf("error in closing browser [%v]: %v", b.id, err)
+	}
+	b.launcher.Kill()
+	b.launcher.Cleanup()
+	b.launcher, b.browser, b.page = nil, nil, nil
+}
+
+// close shuts down all the browsers, it waits for the browsers in use to be released.
+func (p *browserPool) close() {
+	p.closeOnce.Do(func() {
+		for range p.size {
+			(<-p.browsers).close()
+		}
+		close(p.browsers)
+	})
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBrowserPoolFailsFastInLaunchBackoff(t *testing.T) {
+	p := newBrowserPool(1, 0)
+	launchErr := errors.New("no chrome")
+	b := <-p.browsers
+	b.failures, b.launchErr, b.nextLaunchAt = 1, launchErr, time.Now().Add(time.Hour)
+	p.browsers <- b
+
+	_, _, err := p.screenshot(context.Background(), "about:blank", readinessConfig{})
+	if !errors.Is(err, launchErr) || !strings.Contains(err.Error(), "launched again in") {
+		t.Fatalf("screenshot() error = %v, want the launch error", err)
+	}
+
+	// the slot is back in the pool and closing does not wait for a browser
+	done := make(chan struct{})
+	go func() {
+		p.close()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("close() did not return with an unlaunched slot")
+	}
+}
+
+func TestBrowserPoolScreenshotCancelled(t *testing.T) {
+	p := newBrowserPool(1, 0)
+	b := <-p.browsers
+
+	// all the browsers are in use
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, _, err := p.screenshot(ctx, "about:blank", readinessConfig{}); !errors.Is(err, context.Canceled) {
+		t.Fatalf("screenshot() error = %v, want context canceled", err)
+	}
+
+	p.browsers <- b
+	p.close()
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"image"
+	"log"
+	"time"
+)
+
+const (
+	cadenceSchedule = "schedule"
+	cadenceSteady   = "steady"
+	cadenceRising   = "rising"
+	cadenceQuiet    = "quiet"
+
+	recentCityTrafficSQL = `SELECT ts, x, y, green, yellow, red, dark_red FROM traffic
+		WHERE city = ? AND ts >= ? ORDER BY ts`
+)
+
+// cadenceConfig adapts the interval between the rounds to the trend of the congestion
+// in the recent rounds, starting from the interval of the schedule and within the
+// bounds. The schedule still decides when the capture is off.
+type cadenceConfig struct {
+	Adaptive           bool `json:"adaptive"`
+	MinIntervalMinutes int  `json:"min_interval_minutes"`
+	MaxIntervalMinutes int  `json:"max_interval_minutes"`
+
+	// the trend is the change from the first to the last round within this long
+	TrendMinutes int `json:"trend_minutes"`
+	// rise in the fraction of dark red pixels of the city that speeds up to the min interval
+	RisingDarkRed float64 `json:"rising_dark_red"`
+	// congestion of the city below which the interval is doubled
+	QuietCongestion float64 `json:"quiet_congestion"`
+	// rise in the congestion of a cell that captures it in every round,
+	// even if the cell is sampled less often
+	RisingCellCongestion float64 `json:"rising_cell_congestion"`
+}
+
+func defaultCadenceConfig() cadenceConfig {
+	return cadenceConfig{
+		Adaptive:             false,
+		MinIntervalMinutes:   5,
+		MaxIntervalMinutes:   30,
+		TrendMinutes:         30,
+		RisingDarkRed:        0.02,
+		QuietCongestion:      0.05,
+		RisingCellCongestion: 0.1,
+	}
+}
+
+func (c cadenceConfig) validate() error {
+	if c.MinIntervalMinutes <= 0 || c.MaxIntervalMinutes < c.MinIntervalMinutes {
+		return fmt.Errorf("cadence intervals must be positive, and max must not be less than min")
+	}
+	if c.TrendMinutes <= 0 {
+		return fmt.Errorf("cadence trend must be positive")
+	}
+	if c.RisingDarkRed < 0 || c.QuietCongestion < 0 || c.RisingCellCongestion < 0 {
+		return fmt.Errorf("cadence thresholds must not be negative")
+	}
+	return nil
+}
+
+// roundCadence is the cadence chosen for a round of a city, the interval is the time
+// until the next round. The cells with rising congestion are captured in the round
+// even if they are sampled less often.
+type roundCadence struct {
+	Interval time.Duration
+	Reason   string
+	hotCells map[image.Point]bool
+}
+
+func (c roundCadence) hot(x, y int) bool {
+	return c.hotCells[image.Point{x, y}]
+}
+
+// trafficTrend is the change in the traffic of a city over the recent rounds.
+type trafficTrend struct {
+	rounds int
+	first  trafficCounts
+	last   trafficCounts
+	// change in the congestion of each cell from its first to its last round
+	cellRise map[image.Point]float64
+}
+
+// chooseCadence chooses the cadence of the next round of the city, base is the
+// interval of the schedule at the time of the round.
+func chooseCadence(ctx context.Context, db *sql.DB, conf cadenceConfig, city string,
+	base time.Duration, now time.Time) (roundCadence, error) {
+
+	cadence := roundCadence{Interval: base, Reason: cadenceSchedule}
+	if !conf.Adaptive {
+		return cadence, nil
+	}
+
+	trend, err := getTrafficTrend(ctx, db, city, now.Add(-time.Duration(conf.TrendMinutes)*time.Minute))
+	if err != nil {
+		return cadence, err
+	}
+
+	minInterval := time.Duration(conf.MinIntervalMinutes) * time.Minute
+	maxInterval := time.Duration(conf.MaxIntervalMinutes) * time.Minute
+	cadence.Reason = cadenceSteady
+	switch {
+	case trend.rounds == 0:
+	case trend.rounds > 1 && darkRedFraction(trend.last)-darkRedFraction(trend.first) >= conf.RisingDarkRed:
+		cadence.Interval = minInterval
+		cadence.Reason = cadenceRising
+	case trend.last.congestion() < conf.QuietCongestion:
+		cadence.Interval = 2 * base
+		cadence.Reason = cadenceQuiet
+	}
+	cadence.Interval = min(max(cadence.Interval, minInterval), maxInterval)
+
+	cadence.hotCells = make(map[image.Point]bool)
+	for cell, rise := range trend.cellRise {
+		if rise >= conf.RisingCellCongestion {
+			cadence.hotCells[cell] = true
+		}
+	}
+	return cadence, nil
+}
+
+func darkRedFraction(t trafficCounts) float64 {
+	if t.coloredPixels() == 0 {
+		return 0
+	}
+	return float64(t.DarkRed) / float64(t.coloredPixels())
+}
+
+// getTrafficTrend sums the traffic of the city in each round since the given time,
+// and returns the first and the last round along with the rise of each cell.
+func getTrafficTrend(ctx context.Context, db *sql.DB, city string, since time.Time) (*trafficTrend, error) {
+	rows, err := db.QueryContext(ctx, recentCityTrafficSQL, city, since.Format(time.DateTime))
+	if err != nil {
+		return nil, fmt.Errorf("error in querying recent traffic of [%v]: %w", city, err)
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			log.Printf("error in closing rows: %v", err)
+		}
+	}()
+
+	trend := &trafficTrend{cellRise: make(map[image.Point]float64)}
+	firstCongestion := make(map[image.Point]float64)
+	lastTs := ""
+	for rows.Next() {
+		var ts string
+		var x, y int
+		var green sql.NullInt64
+		var counts trafficCounts
+		if err := rows.Scan(&ts, &x, &y, &green, &counts.Yellow, &counts.Red, &counts.DarkRed); err != nil {
+			return nil, fmt.Errorf("error scanning sqlite row: %w", err)
+		}
+		counts.Green = int(green.Int64)
+
+		if ts != lastTs {
+			trend.rounds++
+			trend.last = trafficCounts{}
+			lastTs = ts
+		}
+		if trend.rounds == 1 {
+			trend.first.Green += counts.Green
+			trend.first.Yellow += counts.Yellow
+			trend.first.Red += counts.Red
+			trend.first.DarkRed += counts.DarkRed
+		}
+		trend.last.Green += counts.Green
+		trend.last.Yellow += counts.Yellow
+		trend.last.Red += counts.Red
+		trend.last.DarkRed += counts.DarkRed
+
+		cell := image.Point{x, y}
+		if first, ok := firstCongestion[cell]; ok {
+			trend.cellRise[cell] = counts.congestion() - first
+		} else {
+			firstCongestion[cell] = counts.congestion()
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("sqlite rows iteration error: %w", err)
+	}
+
+	return trend, nil
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"image"
+	"testing"
+	"time"
+)
+
+// insertTestRound inserts the traffic of the cells of a round of jaipur captured at ts.
+func insertTestRound(t *testing.T, db *sql.DB, ts time.Time, cells map[image.Point]trafficCounts) {
+	t.Helper()
+	for cell, counts := range cells {
+		ssPath := fmt.Sprintf("%v-jaipur-x%v-y%v.png", ts.Format("20060102-150405"), cell.X, cell.Y)
+		if err := insertTraffic(context.Background(), db, "jaipur", ssPath, counts); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestChooseCadence(t *testing.T) {
+	now := time.Now().Truncate(time.Second)
+	conf := defaultCadenceConfig()
+	conf.Adaptive = true
+	base := 10 * time.Minute
+
+	free := trafficCounts{Green: 100}
+	busy := trafficCounts{Green: 50, Yellow: 30, Red: 20}
+	jammed := trafficCounts{Green: 50, Yellow: 20, Red: 20, DarkRed: 10}
+	tests := []struct {
+		name       string
+		rounds     []map[image.Point]trafficCounts
+		base       time.Duration
+		want       time.Duration
+		wantReason string
+	}{
+		{
+			name:       "no rounds",
+			base:       base,
+			want:       base,
+			wantReason: cadenceSteady,
+		},
+		{
+			name:       "steady",
+			rounds:     []map[image.Point]trafficCounts{{{0, 0}: busy}, {{0, 0}: busy}},
+			base:       base,
+			want:       base,
+			wantReason: cadenceSteady,
+		},
+		{
+			name:       "rising dark red",
+			rounds:     []map[image.Point]trafficCounts{{{0, 0}: busy}, {{0, 0}: jammed}},
+			base:       base,
+			want:       time.Duration(conf.MinIntervalMinutes) * time.Minute,
+			wantReason: cadenceRising,
+		},
+		{
+			name:       "dark red in a single round is not a trend",
+			rounds:     []map[image.Point]trafficCounts{{{0, 0}: jammed}},
+			base:       base,
+			want:       base,
+			wantReason: cadenceSteady,
+		},
+		{
+			name:       "quiet",
+			rounds:     []map[image.Point]trafficCounts{{{0, 0}: busy}, {{0, 0}: free}},
+			base:       base,
+			want:       2 * base,
+			wantReason: cadenceQuiet,
+		},
+		{
+			name:       "quiet within the max interval",
+			rounds:     []map[image.Point]trafficCounts{{{0, 0}: free}, {{0, 0}: free}},
+			base:       20 * time.Minute,
+			want:       time.Duration(conf.MaxIntervalMinutes) * time.Minute,
+			wantReason: cadenceQuiet,
+		},
+		{
+			name:       "schedule interval within the min interval",
+			rounds:     []map[image.Point]trafficCounts{{{0, 0}: busy}},
+			base:       time.Minute,
+			want:       time.Duration(conf.MinIntervalMinutes) * time.Minute,
+			wantReason: cadenceSteady,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := newTestDB(t)
+			for i, round := range tt.rounds {
+				insertTestRound(t, db, now.Add(time.Duration(i-len(tt.rounds))*time.Minute), round)
+			}
+
+			cadence, err := chooseCadence(context.Background(), db, conf, "jaipur", tt.base, now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cadence.Interval != tt.want || cadence.Reason != tt.wantReason {
+				t.Errorf("cadence = %v %v, want %v %v", cadence.Interval, cadence.Reason, tt.want, tt.wantReason)
+			}
+		})
+	}
+}
+
+func TestChooseCadenceHotCells(t *testing.T) {
+	now := time.Now().Truncate(time.Second)
+	conf := defaultCadenceConfig()
+	conf.Adaptive = true
+	db := newTestDB(t)
+
+	busy := trafficCounts{Green: 50, Yellow: 30, Red: 20}
+	insertTestRound(t, db, now.Add(-20*time.Minute), map[image.Point]trafficCounts{
+		{0, 0}: {Green: 100}, {1, 0}: busy, {2, 0}: busy,
+	})
+	// a round older than the trend is left out
+	insertTestRound(t, db, now.Add(-time.Duration(conf.TrendMinutes+10)*time.Minute), map[image.Point]trafficCounts{
+		{2, 0}: {Green: 100},
+	})
+	insertTestRound(t, db, now.Add(-10*time.Minute), map[image.Point]trafficCounts{
+		{0, 0}: busy, {1, 0}: busy, {2, 0}: busy,
+	})
+
+	cadence, err := chooseCadence(context.Background(), db, conf, "jaipur", 10*time.Minute, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for x, want := range []bool{true, false, false} {
+		if got := cadence.hot(x, 0); got != want {
+			t.Errorf("cell [%v, 0] is hot = %v, want %v", x, got, want)
+		}
+	}
+}
+
+func TestChooseCadenceNotAdaptive(t *testing.T) {
+	db := newTestDB(t)
+	insertTestRound(t, db, time.Now().Add(-time.Minute), map[image.Point]trafficCounts{{0, 0}: {Green: 100}})
+
+	cadence, err := chooseCadence(context.Background(), db, defaultCadenceConfig(), "jaipur", 10*time.Minute, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cadence.Interval != 10*time.Minute || cadence.Reason != cadenceSchedule {
+		t.Errorf("cadence = %v %v, want the schedule by default", cadence.Interval, cadence.Reason)
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"image/color"
+	"io/fs"
+	"log"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	// colors within this multiple of the tolerance of a class are considered
+	// shifted versions of the class color while calibrating
+	calibrateSearchFactor = 3
+	// the suggested tolerance covers this fraction of the pixels near a class
+	calibrateCoverage = 0.95
+	// anti-aliasing always needs some tolerance even if the samples are uniform
+	calibrateMinTolerance = 5
+	// colors with a smaller spread between channels are map background or labels
+	calibrateMinSaturation = 60
+	calibrateTopColors     = 20
+)
+
+type colorCount struct {
+	color color.RGBA
+	count int
+}
+
+// calibrate builds a color histogram over the sample screenshots in the folder and
+// suggests the color and tolerance of each class of the palette. It prints the most
+// frequent saturated colors and the suggested palette config.
+func calibrate(folder string, p *palette) error {
+	log.Printf("---- calibrating palette with screenshots in [%v] ----", folder)
+	defer log.Println("---- palette calibrated ----")
+
+	hist := make(map[color.RGBA]int)
+	numFiles := 0
+	if err := filepath.WalkDir(folder, func(ssPath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return fmt.Errorf("error in walking dir [%v]: %w", folder, err)
+		}
+		if d.IsDir() || !strings.HasSuffix(d.Name(), ".png") {
+			return nil
+		}
+
+		img, err := readImage(ssPath)
+		if err != nil {
+			return err
+		}
+
+		bounds := img.Bounds()
+		for y := bounds.Min.Y + imageToLeaveOnTop; y < bounds.Min.Y+imageToLeaveOnTop+imageHeightWithLeaveOuts; y++ {
+			for x := bounds.Min.X + imageToLeaveOnLeft; x < bounds.Min.X+imageToLeaveOnLeft+imageWidthWithLeaveOuts; x++ {
+				r, g, b, _ := img.At(x, y).RGBA()
+				c := color.RGBA{uint8(r >> 8), uint8(g >> 8), uint8(b >> 8), 255}
+				if max(c.R, c.G, c.B)-min(c.R, c.G, c.B) < calibrateMinSaturation {
+					continue
+				}
+				hist[c]++
+			}
+		}
+
+		numFiles++
+		return nil
+	}); err != nil {
+		return fmt.Errorf("error in building color histogram [%v]: %w", folder, err)
+	}
+
+	if len(hist) == 0 {
+		return fmt.Errorf("no saturated colors found in [%v] screenshots in [%v]", numFiles, folder)
+	}
+
+	colors := make([]colorCount, 0, len(hist))
+	total := 0
+	for c, count := range hist {
+		colors = append(colors, colorCount{c, count})
+		total += count
+	}
+	sort.Slice(colors, func(i, j int) bool { return colors[i].count > colors[j].count })
+
+	log.Printf("most frequent saturated colors in [%v] screenshots:", numFiles)
+	for _, cc := range colors[:min(calibrateTopColors, len(colors))] {
+		log.Printf("  %v: %v pixels (%.2f%%)", colorToHex(cc.color), cc.count, float64(cc.count)*100/float64(total))
+	}
+
+	suggested := paletteConfig{Metric: p.metric}
+	for _, class := range p.classes {
+		suggested.Classes = append(suggested.Classes, suggestColorClass(p, class, colors))
+	}
+
+	data, err := json.MarshalIndent(map[string]paletteConfig{"palette": suggested}, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error in encoding suggested palette: %w", err)
+	}
+	fmt.Println(string(data))
+	return nil
+}
+
+// suggestColorClass picks the most frequent color near the class as the new color of
+// the class, and the tolerance that covers most of the pixels near the new color.
+func suggestColorClass(p *palette, class colorClass, colors []colorCount) colorClassConfig {
+	radius := class.tolerance * calibrateSearchFactor
+	suggestion := colorClassConfig{Name: class.name, Color: colorToHex(class.color), Tolerance: class.tolerance}
+
+	// colors are sorted by count, so the first color near the class is the most frequent
+	var near []colorCount
+	for _, cc := range colors {
+		if distanceToClass(p, cc.color, class) <= radius {
+			near = append(near, cc)
+		}
+	}
+	if len(near) == 0 {
+		log.Printf("no color found near class [%v], keeping it unchanged", class.name)
+		return suggestion
+	}
+
+	center := colorClass{color: near[0].color, lab: rgbToLab(near[0].color.R, near[0].color.G, near[0].color.B)}
+	type distanceCount struct {
+		distance float64
+		count    int
+	}
+	var distances []distanceCount
+	nearTotal := 0
+	for _, cc := range near {
+		distances = append(distances, distanceCount{distanceToClass(p, cc.color, center), cc.count})
+		nearTotal += cc.count
+	}
+	sort.Slice(distances, func(i, j int) bool { return distances[i].distance < distances[j].distance })
+
+	covered := 0
+	tolerance := float64(calibrateMinTolerance)
+	for _, dc := range distances {
+		covered += dc.count
+		tolerance = max(tolerance, dc.distance)
+		if float64(covered) >= calibrateCoverage*float64(nearTotal) {
+			break
+		}
+	}
+
+	log.Printf("class [%v]: %v => %v, tolerance %.1f => %.1f, [%v] pixels near the class",
+		class.name, colorToHex(class.color), colorToHex(center.color), class.tolerance, tolerance, nearTotal)
+	suggestion.Color = colorToHex(center.color)
+	suggestion.Tolerance = tolerance
+	return suggestion
+}
+
+func distanceToClass(p *palette, c color.RGBA, class colorClass) float64 {
+	return p.distance(c.R, c.G, c.B, rgbToLab(c.R, c.G, c.B), class)
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"image"
 	"image/color"
@@ -20,8 +22,6 @@ import (
 )
 
 const (
-	numRows     = 24 // y
-	numCols     = 16 // x
 	imageWidth  = 1280
 	imageHeight = 800
 
@@ -32,39 +32,67 @@ const (
 
 	imageWidthWithLeaveOuts  = imageWidth - imageToLeaveOnLeft - imageToLeaveOnRight
 	imageHeightWithLeaveOuts = imageHeight - imageToLeaveOnTop - imageToLeaveOnBottom
+
+	coordinatesLabelWidth  = 50
+	coordinatesLabelHeight = 20
+
+	// excluded cells are hatched with lines of this width at this spacing
+	hatchSpacing = 24
+	hatchWidth   = 4
 )
 
-func combineScreenshots(prefix string) error {
-	log.Printf("combining screenshots for Jaipur at %v...", prefix)
-	return combineImage(ssFolder, ssCombFolder, prefix)
-}
+var (
+	hatchBackground = color.RGBA{236, 236, 236, 255}
+	hatchLine       = color.RGBA{196, 196, 196, 255}
+)
 
-func combineMasks(prefix string) error {
-	log.Printf("combining masks for Jaipur at %v...", prefix)
-	return combineImage(maskFolder, maskCombFolder, prefix)
+func combineScreenshots(ctx context.Context, manifest *captureManifest) error {
+	log.Printf("combining screenshots for %v at %v...", manifest.City, manifest.Prefix)
+	return combineImage(ctx, manifest, ssFolder, ssCombFolder, true)
 }
 
-func combineImage(imgFolder, combFolder, prefix string) error {
-	combinedImage := image.NewRGBA(image.Rect(0, 0, numCols*imageWidthWithLeaveOuts, numRows*imageHeightWithLeaveOuts))
-	for x := range numCols {
-		for y := range numRows {
-			fileName := fmt.Sprintf(fileNameFmt, imgFolder, prefix, x, y)
+func combineMasks(ctx context.Context, manifest *captureManifest) error {
+	log.Printf("combining masks for %v at %v...", manifest.City, manifest.Prefix)
+	return combineImage(ctx, manifest, maskFolder, maskCombFolder, false)
+}
 
-			img, err := readImage(fileName)
-			if err != nil {
-				log.Printf("[combine image] %v", err)
-				continue
+// combineImage places the images of the captured cells in a grid. The excluded cells are
+// hatched if hatchExcluded, which is not done for masks as their pixels are read as traffic.
+func combineImage(ctx context.Context, manifest *captureManifest, imgFolder, combFolder string,
+	hatchExcluded bool) error {
+
+	combinedImage := image.NewRGBA(image.Rect(0, 0,
+		manifest.NumCols*imageWidthWithLeaveOuts, manifest.NumRows*imageHeightWithLeaveOuts))
+	if hatchExcluded {
+		for _, cell := range manifest.Cells {
+			if cell.Status == cellStatusExcluded {
+				hatchCell(combinedImage, cell.X, cell.Y)
+				addCoordinatesToImage(combinedImage, cell.X, cell.Y)
 			}
+		}
+	}
+	for _, cell := range manifest.capturedCells() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		x, y := cell.X, cell.Y
+		fileName := fmt.Sprintf(fileNameFmt, imgFolder, manifest.Prefix, x, y)
 
-			minX := x * imageWidthWithLeaveOuts
-			minY := y * imageHeightWithLeaveOuts
-			rect := image.Rect(minX, minY, minX+imageWidthWithLeaveOuts, minY+imageHeightWithLeaveOuts)
-			draw.Draw(combinedImage, rect, img, image.Point{imageToLeaveOnLeft, imageToLeaveOnTop}, draw.Over)
-			addCoordinatesToImage(combinedImage, x, y)
+		img, err := readImage(fileName)
+		if err != nil {
+			log.Printf("[combine image] %v", err)
+			continue
 		}
+
+		minX := x * imageWidthWithLeaveOuts
+		minY := y * imageHeightWithLeaveOuts
+		rect := image.Rect(minX, minY, minX+imageWidthWithLeaveOuts, minY+imageHeightWithLeaveOuts)
+		draw.Draw(combinedImage, rect, img, image.Point{imageToLeaveOnLeft, imageToLeaveOnTop}, draw.Over)
+		addCoordinatesToImage(combinedImage, x, y)
 	}
 
-	return savePNG(fmt.Sprintf(combFileNameFmt, combFolder, prefix), combinedImage)
+	return savePNG(fmt.Sprintf(combFileNameFmt, combFolder, manifest.Prefix), combinedImage)
 }
 
 func readImage(fileName string) (image.Image, error) {
@@ -101,17 +129,27 @@ func savePNG(path string, img image.Image) error {
 	return enc.Encode(file, img)
 }
 
+// cropImage leaves out the UI of the maps from the image. The returned sub image
+// shares the pixels of the image, and its bounds do not start at the origin.
 func cropImage(img *image.Gray) *image.Gray {
-	cropRect := image.Rect(imageToLeaveOnLeft, imageToLeaveOnTop, imageToLeaveOnLeft+imageWidthWithLeaveOuts,
-		imageToLeaveOnTop+imageHeightWithLeaveOuts)
+	minX := img.Bounds().Min.X + imageToLeaveOnLeft
+	minY := img.Bounds().Min.Y + imageToLeaveOnTop
+	cropRect := image.Rect(minX, minY, minX+imageWidthWithLeaveOuts, minY+imageHeightWithLeaveOuts)
 	return img.SubImage(cropRect).(*image.Gray)
 }
 
+// coordinatesRect is the region of the cell in a combined image covered by the coordinates label.
+func coordinatesRect(x, y int) image.Rectangle {
+	minX := x * imageWidthWithLeaveOuts
+	minY := y * imageHeightWithLeaveOuts
+	return image.Rect(minX, minY, minX+coordinatesLabelWidth, minY+coordinatesLabelHeight)
+}
+
 func addCoordinatesToImage(img *image.RGBA, x, y int) {
 	minX := x * imageWidthWithLeaveOuts
 	minY := y * imageHeightWithLeaveOuts
 
-	draw.Draw(img, image.Rect(minX, minY, minX+50, minY+20),
+	draw.Draw(img, coordinatesRect(x, y),
 		&image.Uniform{color.RGBA{255, 255, 255, 255}}, image.Point{}, draw.Src)
 	d := &font.Drawer{
 		Dst:  img,
@@ -122,7 +160,22 @@ func addCoordinatesToImage(img *image.RGBA, x, y int) {
 	d.DrawString(fmt.Sprintf("%v, %v", y, x))
 }
 
-func isolateGrid(dstFolder, grid string, ctrlC <-chan os.Signal) error {
+// hatchCell draws the placeholder of an excluded cell in a combined image.
+func hatchCell(img *image.RGBA, x, y int) {
+	minX := x * imageWidthWithLeaveOuts
+	minY := y * imageHeightWithLeaveOuts
+	for py := minY; py < minY+imageHeightWithLeaveOuts; py++ {
+		for px := minX; px < minX+imageWidthWithLeaveOuts; px++ {
+			if (px+py)%hatchSpacing < hatchWidth {
+				img.SetRGBA(px, py, hatchLine)
+			} else {
+				img.SetRGBA(px, py, hatchBackground)
+			}
+		}
+	}
+}
+
+func isolateGrid(ctx context.Context, city *cityConfig, dstFolder, grid string) error {
 	gridParts := strings.Split(grid, ",")
 	if len(gridParts) != 2 {
 		return fmt.Errorf("invalid grid format: [%s]", grid)
@@ -137,7 +190,7 @@ func isolateGrid(dstFolder, grid string, ctrlC <-chan os.Signal) error {
 	}
 
 	files := []string{}
-	log.Printf("isolating screenshots for grid [%v, %v]", x, y)
+	log.Printf("isolating screenshots of %v for grid [%v, %v]", city.Name, x, y)
 	if err := filepath.WalkDir(ssCombFolder, func(ssCombPath string, d fs.DirEntry, err error) error {
 		if err != nil {
 			return fmt.Errorf("error in walking dir [%v]: %w", ssCombFolder, err)
@@ -151,7 +204,7 @@ func isolateGrid(dstFolder, grid string, ctrlC <-chan os.Signal) error {
 			return fmt.Errorf("error in getting file info [%v]: %w", ssCombPath, err)
 		}
 
-		if !strings.HasSuffix(info.Name(), ".png") {
+		if !strings.HasSuffix(info.Name(), "-"+city.Name+".png") {
 			return nil
 		}
 
@@ -172,7 +225,7 @@ func isolateGrid(dstFolder, grid string, ctrlC <-chan os.Signal) error {
 	log.Printf("found %d files for grid [%v, %v]", len(files), x, y)
 	for _, file := range files {
 		select {
-		case <-ctrlC:
+		case <-ctx.Done():
 			log.Println("shutting down...")
 			return nil
 		default:
@@ -195,6 +248,21 @@ func isolateGridFromCombinedImg(dstFolder, combinedImgPath string, x, y int) err
 		return fmt.Errorf("error reading combined image [%v]: %w", combinedImgPath, err)
 	}
 
+	// combined images taken before the manifest existed
+	// are checked against the size of the image instead
+	numCols := combinedImg.Bounds().Dx() / imageWidthWithLeaveOuts
+	numRows := combinedImg.Bounds().Dy() / imageHeightWithLeaveOuts
+	prefix := strings.TrimSuffix(filepath.Base(combinedImgPath), ".png")
+	if manifest, err := readManifest(prefix); err == nil {
+		numCols, numRows = manifest.NumCols, manifest.NumRows
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if x >= numCols || y >= numRows {
+		log.Printf("grid [%v, %v] is outside of [%v] with [%v x %v] grid", x, y, combinedImgPath, numCols, numRows)
+		return nil
+	}
+
 	isolatedImg := image.NewRGBA(image.Rect(0, 0, imageWidthWithLeaveOuts, imageHeightWithLeaveOuts))
 	rect := image.Rect(0, 0, imageWidthWithLeaveOuts, imageHeightWithLeaveOuts)
 	draw.Draw(isolatedImg, rect, combinedImg, image.Point{x * imageWidthWithLeaveOuts, y * imageHeightWithLeaveOuts}, draw.Over)
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"regexp"
+	"strings"
+)
+
+const (
+	defaultCityName = "jaipur"
+)
+
+var (
+	cityNameRegex = regexp.MustCompile(`^[a-z0-9_]+$`)
+)
+
+type config struct {
+	Cities    []*cityConfig   `json:"cities"`
+	Source    sourceConfig    `json:"source"`
+	Capture   captureConfig   `json:"capture"`
+	Palette   paletteConfig   `json:"palette"`
+	Health    healthConfig    `json:"health"`
+	Schedule  scheduleConfig  `json:"schedule"`
+	Cadence   cadenceConfig   `json:"cadence"`
+	Sampling  samplingConfig  `json:"sampling"`
+	Exclusion exclusionConfig `json:"exclusion"`
+	Sync      syncConfig      `json:"sync"`
+}
+
+type captureConfig struct {
+	// number of retries of a failed or invalid tile, with exponential backoff
+	Retries             int `json:"retries"`
+	RetryBackoffSeconds int `json:"retry_backoff_seconds"`
+
+	// a tile with a larger fraction of a single color is considered blank
+	MaxUniformFraction float64 `json:"max_uniform_fraction"`
+
+	// minimum fraction of cells (not skipped or excluded) captured for the round
+	// to be analyzed, otherwise the round is marked incomplete
+	MinCoverage float64 `json:"min_coverage"`
+}
+
+/*
+cityConfig defines the region that is captured for a city.
+
+	north_west_latitude ------------
+	  |
+	  |    LATITUDE (y)
+	  |
+	south_east_latitude ------------
+
+	  |                                        |
+	north_west_longitude  LONGITUDE (x)  south_east_longitude
+	  |                                        |
+*/
+type cityConfig struct {
+	Name               string  `json:"name"`
+	NorthWestLatitude  float64 `json:"north_west_latitude"`
+	NorthWestLongitude float64 `json:"north_west_longitude"`
+	SouthEastLatitude  float64 `json:"south_east_latitude"`
+	SouthEastLongitude float64 `json:"south_east_longitude"`
+
+	// the tile size must match the area visible in the cropped
+	// screenshot at the given zoom (altitude in meters in maps URL)
+	TileWidthMeters  int `json:"tile_width_meters"`
+	TileHeightMeters int `json:"tile_height_meters"`
+	ZoomMeters       int `json:"zoom_meters"`
+
+	// the cells outside the polygon are not captured, the whole box is captured if empty
+	Boundary []boundaryPoint `json:"boundary,omitempty"`
+}
+
+// gridCell is a single screenshot in the grid of a city,
+// latitude and longitude point to the center of the cell.
+type gridCell struct {
+	X         int
+	Y         int
+	Latitude  float64
+	Longitude float64
+}
+
+func defaultConfig() *config {
+	return &config{
+		Cities: []*cityConfig{
+			{
+				Name:               defaultCityName,
+				NorthWestLatitude:  26.99,
+				NorthWestLongitude: 75.65,
+				SouthEastLatitude:  26.75,
+				SouthEastLongitude: 75.94,
+				TileWidthMeters:    1800,
+				TileHeightMeters:   1100,
+				ZoomMeters:         1200,
+			},
+		},
+		Source:    sourceConfig{Type: sourceTypeGoogle},
+		Capture:   defaultCaptureConfig(),
+		Health:    defaultHealthConfig(),
+		Schedule:  defaultScheduleConfig(),
+		Cadence:   defaultCadenceConfig(),
+		Sampling:  defaultSamplingConfig(),
+		Exclusion: defaultExclusionConfig(),
+		Sync:      defaultSyncConfig(),
+	}
+}
+
+func defaultCaptureConfig() captureConfig {
+	return captureConfig{
+		Retries:             2,
+		RetryBackoffSeconds: 5,
+		MaxUniformFraction:  0.95,
+		MinCoverage:         0.9,
+	}
+}
+
+func loadConfig(path string) (*config, error) {
+	if path == "" {
+		conf := defaultConfig()
+		// parses the default schedule
+		if err := conf.validate(); err != nil {
+			return nil, err
+		}
+		return conf, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error in reading config file [%v]: %w", path, err)
+	}
+
+	conf := config{
+		Capture:   defaultCaptureConfig(),
+		Health:    defaultHealthConfig(),
+		Schedule:  defaultScheduleConfig(),
+		Cadence:   defaultCadenceConfig(),
+		Sampling:  defaultSamplingConfig(),
+		Exclusion: defaultExclusionConfig(),
+		Sync:      defaultSyncConfig(),
+	}
+	if err := json.Unmarshal(data, &conf); err != nil {
+		return nil, fmt.Errorf("error in parsing config file [%v]: %w", path, err)
+	}
+
+	if err := conf.validate(); err != nil {
+		return nil, fmt.Errorf("invalid config file [%v]: %w", path, err)
+	}
+
+	return &conf, nil
+}
+
+func (c *config) validate() error {
+	if len(c.Cities) == 0 {
+		return fmt.Errorf("no city defined")
+	}
+
+	names := make(map[string]struct{}, len(c.Cities))
+	for _, city := range c.Cities {
+		if err := city.validate(); err != nil {
+			return err
+		}
+		if _, ok := names[city.Name]; ok {
+			return fmt.Errorf("duplicate city [%v]", city.Name)
+		}
+		names[city.Name] = struct{}{}
+	}
+
+	if c.Capture.Retries < 0 || c.Capture.RetryBackoffSeconds < 0 {
+		return fmt.Errorf("retries and retry backoff must not be negative")
+	}
+	if c.Capture.MaxUniformFraction <= 0 || c.Capture.MaxUniformFraction > 1 {
+		return fmt.Errorf("max uniform fraction must be in (0, 1]")
+	}
+	if c.Capture.MinCoverage < 0 || c.Capture.MinCoverage > 1 {
+		return fmt.Errorf("min coverage must be in [0, 1]")
+	}
+	if c.Health.CaptureStaleMinutes <= 0 || c.Health.SyncStaleMinutes <= 0 {
+		return fmt.Errorf("stale thresholds of the health config must be positive")
+	}
+	if err := c.Schedule.validate(); err != nil {
+		return err
+	}
+	if err := c.Cadence.validate(); err != nil {
+		return err
+	}
+	if err := c.Sampling.validate(names); err != nil {
+		return err
+	}
+	if err := c.Exclusion.validate(); err != nil {
+		return err
+	}
+	if err := c.Sync.validate(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// city returns the city with the given name, or the first city if name is empty.
+func (c *config) city(name string) (*cityConfig, error) {
+	if name == "" {
+		return c.Cities[0], nil
+	}
+
+	for _, city := range c.Cities {
+		if city.Name == name {
+			return city, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown city [%v]", name)
+}
+
+// cities returns all the cities if name is empty, otherwise only the named city.
+func (c *config) cities(name string) ([]*cityConfig, error) {
+	if name == "" {
+		return c.Cities, nil
+	}
+
+	city, err := c.city(name)
+	if err != nil {
+		return nil, err
+	}
+	return []*cityConfig{city}, nil
+}
+
+func (c *cityConfig) validate() error {
+	// city name becomes part of the file names and ss_path in the DB
+	if !cityNameRegex.MatchString(c.Name) {
+		return fmt.Errorf("invalid city name [%v], only [a-z0-9_] allowed", c.Name)
+	}
+	// the trigger on the traffic table takes x and y from the first "-x" and "-y" in ss_path
+	if strings.HasPrefix(c.Name, "x") || strings.HasPrefix(c.Name, "y") {
+		return fmt.Errorf("invalid city name [%v], must not start with x or y", c.Name)
+	}
+	if c.NorthWestLatitude <= c.SouthEastLatitude {
+		return fmt.Errorf("city [%v]: north west latitude must be greater than south east latitude", c.Name)
+	}
+	if c.NorthWestLongitude >= c.SouthEastLongitude {
+		return fmt.Errorf("city [%v]: north west longitude must be less than south east longitude", c.Name)
+	}
+	if c.TileWidthMeters <= 0 || c.TileHeightMeters <= 0 {
+		return fmt.Errorf("city [%v]: tile size must be positive", c.Name)
+	}
+	if c.ZoomMeters <= 0 {
+		return fmt.Errorf("city [%v]: zoom must be positive", c.Name)
+	}
+	metersPerPixel := zoomMetersPerPixel(c.ZoomMeters)
+	width, height := metersPerPixel*imageWidthWithLeaveOuts, metersPerPixel*imageHeightWithLeaveOuts
+	if math.Abs(float64(c.TileWidthMeters)-width) > maxTileSizeError*width ||
+		math.Abs(float64(c.TileHeightMeters)-height) > maxTileSizeError*height {
+		return fmt.Errorf("city [%v]: tile size must be about %.0fx%.0f meters at zoom [%v]",
+			c.Name, width, height, c.ZoomMeters)
+	}
+	if len(c.Boundary) > 0 && len(c.Boundary) < 3 {
+		return fmt.Errorf("city [%v]: boundary must have at least 3 points", c.Name)
+	}
+	return nil
+}
+
+// cells steps through the bounding box of the city, row by row
+// from north west to south east, and returns all the grid cells.
+func (c *cityConfig) cells() []gridCell {
+	// latitude is vertical => y, longitude is horizontal => x
+	var x, y int
+	lat := addMetersInLatitude(c.NorthWestLatitude, c.TileHeightMeters/2)
+	long := addMetersInLongitude(lat, c.NorthWestLongitude, c.TileWidthMeters/2)
+
+	var cells []gridCell
+	for {
+		cells = append(cells, gridCell{X: x, Y: y, Latitude: lat, Longitude: long})
+
+		x += 1
+		long = addMetersInLongitude(lat, long, c.TileWidthMeters)
+		if long > c.SouthEastLongitude {
+			y += 1
+			x = 0
+			lat = addMetersInLatitude(lat, c.TileHeightMeters)
+			long = addMetersInLongitude(lat, c.NorthWestLongitude, c.TileWidthMeters/2)
+		}
+		if lat < c.SouthEastLatitude {
+			break
+		}
+	}
+
+	return cells
+}
@@ -0,0 +1,48 @@
+package main
+
+import "testing"
+
+func TestCityNameValidation(t *testing.T) {
+	tests := []struct {
+		name  string
+		valid bool
+	}{
+		{name: "jaipur", valid: true},
+		{name: "new_delhi2", valid: true},
+		{name: "Jaipur", valid: false},
+		{name: "new-delhi", valid: false},
+		// these would be parsed as the x and y of the cell from ss_path
+		{name: "xian", valid: false},
+		{name: "yangon", valid: false},
+	}
+
+	for _, tt := range tests {
+		city := defaultConfig().Cities[0]
+		city.Name = tt.name
+		if err := city.validate(); (err == nil) != tt.valid {
+			t.Errorf("validate() of city [%v] = %v, want valid %v", tt.name, err, tt.valid)
+		}
+	}
+}
+
+func TestTileSizeValidation(t *testing.T) {
+	tests := []struct {
+		width, height, zoom int
+		valid               bool
+	}{
+		{width: 1800, height: 1100, zoom: 1200, valid: true},
+		{width: 900, height: 550, zoom: 600, valid: true},
+		{width: 1700, height: 1050, zoom: 1200, valid: true},
+		{width: 1800, height: 1100, zoom: 600, valid: false},
+		{width: 1800, height: 1800, zoom: 1200, valid: false},
+		{width: 2200, height: 1100, zoom: 1200, valid: false},
+	}
+
+	for _, tt := range tests {
+		city := defaultConfig().Cities[0]
+		city.TileWidthMeters, city.TileHeightMeters, city.ZoomMeters = tt.width, tt.height, tt.zoom
+		if err := city.validate(); (err == nil) != tt.valid {
+			t.Errorf("validate() of tile %vx%v at zoom %v = %v, want valid %v", tt.width, tt.height, tt.zoom, err, tt.valid)
+		}
+	}
+}
@@ -1,11 +1,14 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"log"
 	"path/filepath"
 	"strings"
+	"time"
 
 	_ "github.com/mattn/go-sqlite3"
 )
@@ -14,10 +17,57 @@ const (
 	dbFile = "traffic.db"
 
 	trafficTableDDL  = `CREATE TABLE IF NOT EXISTS traffic(ss_path VARCHAR PRIMARY KEY, yellow INTEGER, red INTEGER, dark_red INTEGER)`
-	insertTrafficSQL = `INSERT OR REPLACE INTO traffic(ss_path, yellow, red, dark_red) VALUES(?, ?, ?, ?)`
+	insertTrafficSQL = `INSERT OR REPLACE INTO traffic(ss_path, yellow, red, dark_red, city, green, congestion,
+		road_pixels, yellow_pct, red_pct, dark_red_pct, version) VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	updateTrafficSQL = `UPDATE traffic SET green = ?, yellow = ?, red = ?, dark_red = ?, congestion = ?,
+		road_pixels = ?, yellow_pct = ?, red_pct = ?, dark_red_pct = ?, version = ? WHERE ss_path = ?`
+	touchTrafficSQL = `UPDATE traffic SET version = ? WHERE ss_path = ?`
 
-	maxRecentRows    = 100
-	recentTrafficSQL = `SELECT * FROM traffic WHERE ss_path > ? ORDER BY ss_path ASC LIMIT %v`
+	roadMaskTableDDL = `CREATE TABLE IF NOT EXISTS road_mask(city TEXT, x INTEGER, y INTEGER,
+		road_pixels INTEGER, updated_at TEXT, PRIMARY KEY (city, x, y))`
+	insertRoadMaskSQL = `INSERT OR REPLACE INTO road_mask(city, x, y, road_pixels, updated_at) VALUES(?, ?, ?, ?, ?)`
+
+	segmentTrafficTableDDL = `CREATE TABLE IF NOT EXISTS segment_traffic(ss_path VARCHAR, segment_id INTEGER,
+		city TEXT, ts TEXT, x INTEGER, y INTEGER, green INTEGER, yellow INTEGER, red INTEGER, dark_red INTEGER,
+		road_pixels INTEGER, congestion REAL, PRIMARY KEY (ss_path, segment_id))`
+	deleteSegmentTrafficSQL = `DELETE FROM segment_traffic WHERE ss_path = ?`
+	insertSegmentTrafficSQL = `INSERT INTO segment_traffic(ss_path, segment_id, city, ts, x, y, green, yellow, red,
+		dark_red, road_pixels, congestion) VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	segmentTrafficSQL = `SELECT segment_id, city, ts, x, y, green, yellow, red, dark_red, road_pixels, congestion
+		FROM segment_traffic WHERE ss_path = ?`
+
+	captureRoundTableDDL = `CREATE TABLE IF NOT EXISTS capture_round(prefix VARCHAR PRIMARY KEY, city TEXT, ts TEXT,
+		status TEXT, coverage REAL, captured INTEGER, skipped INTEGER, failed INTEGER)`
+	insertCaptureRoundSQL = `INSERT OR REPLACE INTO capture_round(prefix, city, ts, status, coverage, captured, skipped, failed,
+		interval_minutes, excluded) VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	captureStatusTableDDL = `CREATE TABLE IF NOT EXISTS capture_status(prefix VARCHAR, x INTEGER, y INTEGER,
+		status TEXT, retries INTEGER, error TEXT, captured_at TEXT, PRIMARY KEY (prefix, x, y))`
+	insertCaptureStatusSQL = `INSERT OR REPLACE INTO capture_status(prefix, x, y, status, retries, error, captured_at,
+		time_to_ready_ms) VALUES(?, ?, ?, ?, ?, ?, ?, ?)`
+
+	cellGeoTableDDL = `CREATE TABLE IF NOT EXISTS cell_geo(city TEXT, x INTEGER, y INTEGER, latitude REAL,
+		longitude REAL, meters_per_pixel REAL, north REAL, west REAL, south REAL, east REAL, PRIMARY KEY (city, x, y))`
+	insertCellGeoSQL = `INSERT OR REPLACE INTO cell_geo(city, x, y, latitude, longitude, meters_per_pixel,
+		north, west, south, east) VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+
+	samplingPolicyTableDDL = `CREATE TABLE IF NOT EXISTS sampling_policy(city TEXT, x INTEGER, y INTEGER,
+		every INTEGER, rounds INTEGER, congestion_stddev REAL, road_coverage REAL, updated_at TEXT,
+		PRIMARY KEY (city, x, y))`
+
+	excludedCellTableDDL = `CREATE TABLE IF NOT EXISTS excluded_cell(city TEXT, x INTEGER, y INTEGER,
+		rounds INTEGER, updated_at TEXT, PRIMARY KEY (city, x, y))`
+
+	latestSsPathSQL = `SELECT ss_path FROM traffic ORDER BY ss_path DESC LIMIT 1`
+
+	// a row is synced to postgres if its synced version is its version, which changes
+	// whenever the row is written. The rows from before the versions have neither.
+	unsyncedTrafficSQL = `SELECT ss_path, yellow, red, dark_red, ts, x, y, city, green, congestion,
+		road_pixels, yellow_pct, red_pct, dark_red_pct, version FROM traffic
+		WHERE synced_version IS NOT version ORDER BY ss_path ASC LIMIT ?`
+	markTrafficSyncedSQL   = `UPDATE traffic SET synced_version = ? WHERE ss_path = ?`
+	markTrafficUnsyncedSQL = `UPDATE traffic SET version = 0 WHERE version IS NULL AND ss_path > ?`
+	latestSyncedSsPathSQL  = `SELECT ss_path FROM traffic WHERE synced_version IS version
+		ORDER BY ss_path DESC LIMIT 1`
 )
 
 var (
@@ -57,6 +107,22 @@ var (
 
 				WHERE ss_path = NEW.ss_path;
 			END;`,
+		"ALTER TABLE traffic ADD COLUMN city TEXT;",
+		// all the rows before multi city support are from Jaipur
+		"UPDATE traffic SET city = 'jaipur' WHERE city IS NULL;",
+		"ALTER TABLE capture_status ADD COLUMN time_to_ready_ms INTEGER;",
+		"ALTER TABLE traffic ADD COLUMN green INTEGER;",
+		"ALTER TABLE traffic ADD COLUMN congestion REAL;",
+		"ALTER TABLE traffic ADD COLUMN road_pixels INTEGER;",
+		"ALTER TABLE traffic ADD COLUMN yellow_pct REAL;",
+		"ALTER TABLE traffic ADD COLUMN red_pct REAL;",
+		"ALTER TABLE traffic ADD COLUMN dark_red_pct REAL;",
+		"ALTER TABLE capture_round ADD COLUMN interval_minutes INTEGER;",
+		"ALTER TABLE capture_round ADD COLUMN excluded INTEGER;",
+		"ALTER TABLE traffic ADD COLUMN version INTEGER;",
+		"ALTER TABLE traffic ADD COLUMN synced_version INTEGER;",
+		"CREATE INDEX IF NOT EXISTS idx_traffic_unsynced ON traffic(ss_path) WHERE synced_version IS NOT version;",
+		"CREATE INDEX IF NOT EXISTS idx_traffic_city_xy_ts ON traffic(city, x, y, ts);",
 	}
 )
 
@@ -65,6 +131,34 @@ func initDB(db *sql.DB) error {
 		return fmt.Errorf("error in creating table [traffic]: %w", err)
 	}
 
+	if _, err := db.Exec(captureRoundTableDDL); err != nil {
+		return fmt.Errorf("error in creating table [capture_round]: %w", err)
+	}
+
+	if _, err := db.Exec(captureStatusTableDDL); err != nil {
+		return fmt.Errorf("error in creating table [capture_status]: %w", err)
+	}
+
+	if _, err := db.Exec(roadMaskTableDDL); err != nil {
+		return fmt.Errorf("error in creating table [road_mask]: %w", err)
+	}
+
+	if _, err := db.Exec(segmentTrafficTableDDL); err != nil {
+		return fmt.Errorf("error in creating table [segment_traffic]: %w", err)
+	}
+
+	if _, err := db.Exec(cellGeoTableDDL); err != nil {
+		return fmt.Errorf("error in creating table [cell_geo]: %w", err)
+	}
+
+	if _, err := db.Exec(samplingPolicyTableDDL); err != nil {
+		return fmt.Errorf("error in creating table [sampling_policy]: %w", err)
+	}
+
+	if _, err := db.Exec(excludedCellTableDDL); err != nil {
+		return fmt.Errorf("error in creating table [excluded_cell]: %w", err)
+	}
+
 	if err := migrateDB(db); err != nil {
 		return fmt.Errorf("error in migrating db: %w", err)
 	}
@@ -98,11 +192,180 @@ func openDB() (*sql.DB, func(), error) {
 	return db, closeDB, nil
 }
 
-func insertTraffic(db *sql.DB, ssPath string, yellow, red, darkRed int) error {
-	_, err := db.Exec(insertTrafficSQL, filepath.Base(ssPath), yellow, red, darkRed)
+func insertTraffic(ctx context.Context, db *sql.DB, city, ssPath string, counts trafficCounts) error {
+	_, err := db.ExecContext(ctx, insertTrafficSQL, filepath.Base(ssPath), counts.Yellow, counts.Red, counts.DarkRed,
+		city, counts.Green, counts.congestion(), counts.RoadPixels, counts.percent(counts.Yellow),
+		counts.percent(counts.Red), counts.percent(counts.DarkRed), newTrafficVersion())
+	return err
+}
+
+// updateTraffic overwrites the counts of an existing row, it returns false if there is no such row.
+func updateTraffic(ctx context.Context, db *sql.DB, ssPath string, counts trafficCounts) (bool, error) {
+	result, err := db.ExecContext(ctx, updateTrafficSQL, counts.Green, counts.Yellow, counts.Red, counts.DarkRed,
+		counts.congestion(), counts.RoadPixels, counts.percent(counts.Yellow), counts.percent(counts.Red),
+		counts.percent(counts.DarkRed), newTrafficVersion(), filepath.Base(ssPath))
+	if err != nil {
+		return false, err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+func insertRoadMask(ctx context.Context, db *sql.DB, city string, x, y, roadPixels int) error {
+	_, err := db.ExecContext(ctx, insertRoadMaskSQL, city, x, y, roadPixels, time.Now().Format(time.DateTime))
 	return err
 }
 
-func getRecentTraffic(db *sql.DB, ssPath string) (*sql.Rows, error) {
-	return db.Query(fmt.Sprintf(recentTrafficSQL, maxRecentRows), ssPath)
+// newTrafficVersion returns the version of a row of traffic being written.
+func newTrafficVersion() int64 {
+	return time.Now().UnixNano()
+}
+
+// insertSegmentTraffic replaces the segment traffic of the screenshot,
+// and changes the version of its traffic for the segments to be synced.
+func insertSegmentTraffic(ctx context.Context, db *sql.DB, city, ssPath string, x, y int, segments []segmentCounts) (err error) {
+	ssPath = filepath.Base(ssPath)
+	ts, err := time.Parse("20060102-150405", ssPath[:min(len(ssPath), 15)])
+	if err != nil {
+		return fmt.Errorf("error in parsing timestamp of [%v]: %w", ssPath, err)
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("error in starting transaction: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	if _, err = tx.ExecContext(ctx, deleteSegmentTrafficSQL, ssPath); err != nil {
+		return err
+	}
+	for _, s := range segments {
+		if _, err = tx.ExecContext(ctx, insertSegmentTrafficSQL, ssPath, s.ID, city, ts.Format(time.DateTime), x, y,
+			s.Green, s.Yellow, s.Red, s.DarkRed, s.RoadPixels, s.congestion()); err != nil {
+			return err
+		}
+	}
+	if _, err = tx.ExecContext(ctx, touchTrafficSQL, newTrafficVersion(), ssPath); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func getSegmentTraffic(ctx context.Context, db *sql.DB, ssPath string) (*sql.Rows, error) {
+	return db.QueryContext(ctx, segmentTrafficSQL, ssPath)
+}
+
+// getLatestSsPath returns the latest screenshot in the traffic table, empty if there is none.
+func getLatestSsPath(ctx context.Context, db *sql.DB) (string, error) {
+	var ssPath string
+	if err := db.QueryRowContext(ctx, latestSsPathSQL).Scan(&ssPath); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return "", err
+	}
+	return ssPath, nil
+}
+
+// ssPathTime returns the time of the round of the screenshot from its name.
+func ssPathTime(ssPath string) (time.Time, error) {
+	name := filepath.Base(ssPath)
+	ts, err := time.ParseInLocation("20060102-150405", name[:min(len(name), 15)], time.Local)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("error in parsing timestamp of [%v]: %w", ssPath, err)
+	}
+	return ts, nil
+}
+
+func getUnsyncedTraffic(ctx context.Context, db *sql.DB, limit int) (*sql.Rows, error) {
+	return db.QueryContext(ctx, unsyncedTrafficSQL, limit)
+}
+
+// markTrafficSynced records the versions of the rows synced to postgres. A row
+// written again since it was read stays unsynced as its version has changed.
+func markTrafficSynced(ctx context.Context, db *sql.DB, versions map[string]int64) (err error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("error in starting transaction: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	for ssPath, version := range versions {
+		if _, err = tx.ExecContext(ctx, markTrafficSyncedSQL, version, ssPath); err != nil {
+			return fmt.Errorf("error in marking traffic synced [%v]: %w", ssPath, err)
+		}
+	}
+	return tx.Commit()
+}
+
+// markTrafficUnsynced marks the rows from before the versions that are after
+// the screenshot to be synced, the ones until it are already in postgres.
+func markTrafficUnsynced(ctx context.Context, db *sql.DB, ssPath string) error {
+	_, err := db.ExecContext(ctx, markTrafficUnsyncedSQL, ssPath)
+	return err
+}
+
+// getLatestSyncedSsPath returns the latest screenshot synced to postgres, empty if there is none.
+func getLatestSyncedSsPath(ctx context.Context, db *sql.DB) (string, error) {
+	var ssPath string
+	if err := db.QueryRowContext(ctx, latestSyncedSsPathSQL).Scan(&ssPath); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return "", err
+	}
+	return ssPath, nil
+}
+
+func insertCaptureRound(ctx context.Context, db *sql.DB, manifest *captureManifest) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("error in starting transaction: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	counts := make(map[string]int)
+	for _, cell := range manifest.Cells {
+		counts[cell.Status]++
+
+		var capturedAt string
+		if !cell.CapturedAt.IsZero() {
+			capturedAt = cell.CapturedAt.Format(time.DateTime)
+		}
+		if _, err = tx.ExecContext(ctx, insertCaptureStatusSQL, manifest.Prefix, cell.X, cell.Y,
+			cell.Status, cell.Retries, cell.Error, capturedAt, cell.TimeToReadyMillis); err != nil {
+			return fmt.Errorf("error in inserting capture status [%v]: %w", manifest.Prefix, err)
+		}
+
+		north, west, south, east := cell.Geo.bounds()
+		if _, err = tx.ExecContext(ctx, insertCellGeoSQL, manifest.City, cell.X, cell.Y, cell.Geo.Latitude, cell.Geo.Longitude,
+			cell.Geo.MetersPerPixel, north, west, south, east); err != nil {
+			return fmt.Errorf("error in inserting cell geo [%v]: %w", manifest.Prefix, err)
+		}
+	}
+
+	// the interval is only known for the rounds captured periodically
+	intervalMinutes := sql.NullInt64{Int64: int64(manifest.IntervalMinutes), Valid: manifest.IntervalMinutes > 0}
+	if _, err = tx.ExecContext(ctx, insertCaptureRoundSQL, manifest.Prefix, manifest.City,
+		manifest.Timestamp.Format(time.DateTime), manifest.Status, manifest.Coverage,
+		counts[cellStatusCaptured], counts[cellStatusSkipped], counts[cellStatusFailed], intervalMinutes,
+		counts[cellStatusExcluded]); err != nil {
+		return fmt.Errorf("error in inserting capture round [%v]: %w", manifest.Prefix, err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("error in committing capture round [%v]: %w", manifest.Prefix, err)
+	}
+	return nil
 }
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"testing"
+)
+
+// newTestDB returns an initialised in-memory sqlite DB.
+func newTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// each connection has its own in-memory DB
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { _ = db.Close() })
+
+	if err := initDB(db); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestTrafficTriggerParsesSsPath(t *testing.T) {
+	db := newTestDB(t)
+	ctx := context.Background()
+
+	for _, city := range []string{"jaipur", "ax", "bay_city", "new_yx"} {
+		ssPath := fmt.Sprintf("20250102-150405-%v-x13-y7.png", city)
+		if err := insertTraffic(ctx, db, city, ssPath, trafficCounts{}); err != nil {
+			t.Fatal(err)
+		}
+
+		var ts string
+		var x, y int
+		if err := db.QueryRow(`SELECT ts, x, y FROM traffic WHERE ss_path = ?`, ssPath).Scan(&ts, &x, &y); err != nil {
+			t.Fatal(err)
+		}
+		if ts != "2025-01-02 15:04:05" || x != 13 || y != 7 {
+			t.Errorf("[%v] parsed as ts: %v, x: %v, y: %v", ssPath, ts, x, y)
+		}
+	}
+}
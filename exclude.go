@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"image"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	insertExcludedCellSQL = `INSERT OR REPLACE INTO excluded_cell(city, x, y, rounds, updated_at) VALUES(?, ?, ?, ?, ?)`
+	deleteExcludedCellSQL = `DELETE FROM excluded_cell WHERE city = ? AND x = ? AND y = ?`
+	excludedCellsSQL      = `SELECT x, y FROM excluded_cell WHERE city = ?`
+
+	cellColoredPixelsSQL = `SELECT x, y, COUNT(*), COALESCE(SUM(COALESCE(green, 0) + yellow + red + dark_red), 0)
+		FROM traffic WHERE city = ? AND ts >= ? GROUP BY x, y`
+)
+
+// exclusionConfig leaves out the cells that never have any road, e.g. lakes and hills
+// within the bounding box of a city. A cell is excluded if it is outside the boundary
+// of the city, or automatically if none of its rounds in the last empty_days had any
+// colored pixel.
+type exclusionConfig struct {
+	Auto         bool `json:"auto"`
+	EmptyDays    int  `json:"empty_days"`
+	RefreshHours int  `json:"refresh_hours"`
+	// cells with fewer rounds in the last empty_days are not excluded automatically
+	MinRounds int `json:"min_rounds"`
+	// an automatically excluded cell is still captured once every recheck_every rounds,
+	// and is included again once it has a colored pixel, 0 never captures it
+	RecheckEvery int `json:"recheck_every"`
+}
+
+// boundaryPoint is a vertex of the polygon of the boundary of a city.
+type boundaryPoint struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+}
+
+func defaultExclusionConfig() exclusionConfig {
+	return exclusionConfig{
+		Auto:         true,
+		EmptyDays:    14,
+		RefreshHours: 24,
+		MinRounds:    200,
+		RecheckEvery: 144,
+	}
+}
+
+func (c exclusionConfig) validate() error {
+	if c.EmptyDays <= 0 || c.RefreshHours <= 0 || c.MinRounds <= 0 {
+		return fmt.Errorf("exclusion empty days, refresh and min rounds must be positive")
+	}
+	if c.RecheckEvery < 0 {
+		return fmt.Errorf("exclusion recheck must not be negative")
+	}
+	return nil
+}
+
+// exclusionMap is the set of cells left out of the rounds of each city.
+type exclusionMap struct {
+	mu sync.RWMutex
+	// city => cells outside the boundary of the city
+	outside map[string]map[image.Point]bool
+	// city => cells excluded as they had no colored pixels
+	empty        map[string]map[image.Point]bool
+	refreshedAt  map[string]time.Time
+	recheckEvery int
+}
+
+// exclusions are the cells left out in capturing the rounds.
+var exclusions = newExclusionMap()
+
+func newExclusionMap() *exclusionMap {
+	return &exclusionMap{
+		outside:     make(map[string]map[image.Point]bool),
+		empty:       make(map[string]map[image.Point]bool),
+		refreshedAt: make(map[string]time.Time),
+	}
+}
+
+// excluded returns whether the cell is left out of the round. The automatically
+// excluded cells are rechecked in different rounds as per their position.
+func (e *exclusionMap) excluded(city string, x, y, round int) bool {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	cell := image.Point{x, y}
+	if e.outside[city][cell] {
+		return true
+	}
+	if !e.empty[city][cell] {
+		return false
+	}
+	return e.recheckEvery == 0 || (round+x+y)%e.recheckEvery != 0
+}
+
+// refresh recomputes the excluded cells of the cities that were not refreshed
+// for the refresh period, the first call computes all of them.
+func (e *exclusionMap) refresh(ctx context.Context, db *sql.DB, conf exclusionConfig, cities []*cityConfig) error {
+	e.mu.Lock()
+	e.recheckEvery = conf.RecheckEvery
+	e.mu.Unlock()
+
+	for _, city := range cities {
+		e.mu.RLock()
+		refreshedAt := e.refreshedAt[city.Name]
+		e.mu.RUnlock()
+		if time.Since(refreshedAt) < time.Duration(conf.RefreshHours)*time.Hour {
+			continue
+		}
+
+		outside := outsideCells(city)
+		var empty map[image.Point]bool
+		if conf.Auto {
+			var err error
+			if empty, err = computeEmptyCells(ctx, db, conf, city.Name); err != nil {
+				return fmt.Errorf("error in computing empty cells of [%v]: %w", city.Name, err)
+			}
+		}
+
+		e.mu.Lock()
+		e.outside[city.Name] = outside
+		e.empty[city.Name] = empty
+		e.refreshedAt[city.Name] = time.Now()
+		e.mu.Unlock()
+		log.Printf("excluded [%v] cells outside the boundary and [%v] empty cells of %v",
+			len(outside), len(empty), city.Name)
+	}
+	return nil
+}
+
+// computeEmptyCells updates the persisted empty cells of the city from the rounds since
+// the empty days, and returns them. A cell stays excluded until it has a colored pixel,
+// even if it has too few rounds since then as it is only rechecked now and then.
+func computeEmptyCells(ctx context.Context, db *sql.DB, conf exclusionConfig,
+	city string) (empty map[image.Point]bool, err error) {
+
+	since := time.Now().AddDate(0, 0, -conf.EmptyDays)
+	rows, err := db.QueryContext(ctx, cellColoredPixelsSQL, city, since.Format(time.DateTime))
+	if err != nil {
+		return nil, fmt.Errorf("error in querying colored pixels of cells: %w", err)
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			log.Printf("error in closing rows: %v", err)
+		}
+	}()
+
+	type cellPixels struct {
+		cell    image.Point
+		rounds  int
+		colored int64
+	}
+	var history []cellPixels
+	for rows.Next() {
+		var h cellPixels
+		if err := rows.Scan(&h.cell.X, &h.cell.Y, &h.rounds, &h.colored); err != nil {
+			return nil, fmt.Errorf("error scanning sqlite row: %w", err)
+		}
+		history = append(history, h)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("sqlite rows iteration error: %w", err)
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error in starting transaction: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	updatedAt := time.Now().Format(time.DateTime)
+	for _, h := range history {
+		switch {
+		case h.colored > 0:
+			if _, err = tx.ExecContext(ctx, deleteExcludedCellSQL, city, h.cell.X, h.cell.Y); err != nil {
+				return nil, fmt.Errorf("error in deleting excluded cell: %w", err)
+			}
+		case h.rounds >= conf.MinRounds:
+			if _, err = tx.ExecContext(ctx, insertExcludedCellSQL, city, h.cell.X, h.cell.Y,
+				h.rounds, updatedAt); err != nil {
+				return nil, fmt.Errorf("error in inserting excluded cell: %w", err)
+			}
+		}
+	}
+
+	excludedRows, err := tx.QueryContext(ctx, excludedCellsSQL, city)
+	if err != nil {
+		return nil, fmt.Errorf("error in querying excluded cells: %w", err)
+	}
+	empty = make(map[image.Point]bool)
+	for excludedRows.Next() {
+		var cell image.Point
+		if err = excludedRows.Scan(&cell.X, &cell.Y); err != nil {
+			_ = excludedRows.Close()
+			return nil, fmt.Errorf("error scanning sqlite row: %w", err)
+		}
+		empty[cell] = true
+	}
+	if err = excludedRows.Err(); err != nil {
+		return nil, fmt.Errorf("sqlite rows iteration error: %w", err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, fmt.Errorf("error in committing excluded cells: %w", err)
+	}
+	return empty, nil
+}
+
+// outsideCells returns the cells of the city whose cropped region does not
+// overlap the boundary of the city, none if the city has no boundary.
+func outsideCells(city *cityConfig) map[image.Point]bool {
+	outside := make(map[image.Point]bool)
+	if len(city.Boundary) == 0 {
+		return outside
+	}
+
+	for _, cell := range city.cells() {
+		north, west, south, east := newGeoTransform(city, cell.Latitude, cell.Longitude).bounds()
+		if !overlapsPolygon(city.Boundary, north, west, south, east) {
+			outside[image.Point{cell.X, cell.Y}] = true
+		}
+	}
+	return outside
+}
+
+// overlapsPolygon returns whether the rectangle overlaps the polygon, i.e. a corner
+// of either is inside the other or an edge of the polygon crosses the rectangle.
+func overlapsPolygon(polygon []boundaryPoint, north, west, south, east float64) bool {
+	corners := []boundaryPoint{{north, west}, {north, east}, {south, east}, {south, west}}
+	for _, corner := range corners {
+		if insidePolygon(polygon, corner) {
+			return true
+		}
+	}
+
+	for i, p := range polygon {
+		if p.Latitude <= north && p.Latitude >= south && p.Longitude >= west && p.Longitude <= east {
+			return true
+		}
+		q := polygon[(i+1)%len(polygon)]
+		for j, c := range corners {
+			if segmentsCross(p, q, c, corners[(j+1)%len(corners)]) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// insidePolygon tests the point by casting a ray along the latitude of the point.
+func insidePolygon(polygon []boundaryPoint, point boundaryPoint) bool {
+	inside := false
+	for i, p := range polygon {
+		q := polygon[(i+1)%len(polygon)]
+		if (p.Latitude > point.Latitude) != (q.Latitude > point.Latitude) {
+			longitude := p.Longitude + (point.Latitude-p.Latitude)/(q.Latitude-p.Latitude)*(q.Longitude-p.Longitude)
+			if point.Longitude < longitude {
+				inside = !inside
+			}
+		}
+	}
+	return inside
+}
+
+// segmentsCross returns whether the segments ab and cd properly cross each other.
+func segmentsCross(a, b, c, d boundaryPoint) bool {
+	orientation := func(p, q, r boundaryPoint) float64 {
+		return (q.Longitude-p.Longitude)*(r.Latitude-p.Latitude) - (q.Latitude-p.Latitude)*(r.Longitude-p.Longitude)
+	}
+	d1, d2 := orientation(c, d, a), orientation(c, d, b)
+	d3, d4 := orientation(a, b, c), orientation(a, b, d)
+	return ((d1 > 0 && d2 < 0) || (d1 < 0 && d2 > 0)) && ((d3 > 0 && d4 < 0) || (d3 < 0 && d4 > 0))
+}
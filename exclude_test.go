@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"testing"
+	"time"
+)
+
+func TestOverlapsPolygon(t *testing.T) {
+	square := []boundaryPoint{{0, 0}, {0, 10}, {10, 10}, {10, 0}}
+	// a thin strip along the latitude 5 with its vertices far from the cells
+	strip := []boundaryPoint{{4.9, -10}, {4.9, 10}, {5.1, 10}, {5.1, -10}}
+	// a triangle within the cell [north 6, west 4, south 4, east 6]
+	small := []boundaryPoint{{4.5, 4.5}, {4.5, 5.5}, {5.5, 5}}
+
+	tests := []struct {
+		name                     string
+		polygon                  []boundaryPoint
+		north, west, south, east float64
+		want                     bool
+	}{
+		{"cell inside", square, 3, 2, 2, 3, true},
+		{"cell outside", square, 21, 20, 20, 21, false},
+		{"cell across an edge", square, 11, 4, 9, 6, true},
+		{"cell around a corner", square, 11, 9, 9, 11, true},
+		{"edge crossing the cell without any vertex inside", strip, 6, -1, 4, 1, true},
+		{"cell beside the strip", strip, 8, -1, 6, 1, false},
+		{"polygon inside the cell", small, 6, 4, 4, 6, true},
+		{"polygon inside another cell", small, 6, 6.5, 4, 8, false},
+		{"cell covering the polygon", square, 20, -10, -10, 20, true},
+	}
+
+	for _, tt := range tests {
+		if got := overlapsPolygon(tt.polygon, tt.north, tt.west, tt.south, tt.east); got != tt.want {
+			t.Errorf("%v: overlaps = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestInsidePolygon(t *testing.T) {
+	// a concave polygon, the notch between the longitudes 4 and 6 is cut from the top
+	notched := []boundaryPoint{{0, 0}, {0, 10}, {10, 10}, {10, 6}, {5, 5}, {10, 4}, {10, 0}}
+
+	tests := []struct {
+		point boundaryPoint
+		want  bool
+	}{
+		{boundaryPoint{2, 2}, true},
+		{boundaryPoint{8, 8}, true},
+		{boundaryPoint{8, 5}, false},
+		{boundaryPoint{4, 5}, true},
+		{boundaryPoint{-1, 5}, false},
+		{boundaryPoint{5, 11}, false},
+	}
+
+	for _, tt := range tests {
+		if got := insidePolygon(notched, tt.point); got != tt.want {
+			t.Errorf("point %v is inside = %v, want %v", tt.point, got, tt.want)
+		}
+	}
+}
+
+func TestSegmentsCross(t *testing.T) {
+	tests := []struct {
+		name       string
+		a, b, c, d boundaryPoint
+		want       bool
+	}{
+		{"crossing", boundaryPoint{0, 0}, boundaryPoint{2, 2}, boundaryPoint{0, 2}, boundaryPoint{2, 0}, true},
+		{"apart", boundaryPoint{0, 0}, boundaryPoint{1, 1}, boundaryPoint{3, 0}, boundaryPoint{3, 3}, false},
+		{"parallel", boundaryPoint{0, 0}, boundaryPoint{0, 2}, boundaryPoint{1, 0}, boundaryPoint{1, 2}, false},
+		{"touching at an end", boundaryPoint{0, 0}, boundaryPoint{1, 1}, boundaryPoint{1, 1}, boundaryPoint{2, 0}, false},
+		{"collinear", boundaryPoint{0, 0}, boundaryPoint{0, 2}, boundaryPoint{0, 1}, boundaryPoint{0, 3}, false},
+	}
+
+	for _, tt := range tests {
+		if got := segmentsCross(tt.a, tt.b, tt.c, tt.d); got != tt.want {
+			t.Errorf("%v: cross = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestComputeEmptyCells(t *testing.T) {
+	db := newTestDB(t)
+	conf := defaultExclusionConfig()
+	conf.MinRounds = 2
+
+	now := time.Now().Truncate(time.Second)
+	empty, colored, fewRounds := image.Point{0, 0}, image.Point{1, 0}, image.Point{2, 0}
+	for i := range 2 {
+		cells := map[image.Point]trafficCounts{empty: {}, colored: {Green: 10}}
+		if i == 0 {
+			cells[fewRounds] = trafficCounts{}
+		}
+		insertTestRound(t, db, now.Add(-time.Duration(i+1)*time.Hour), cells)
+	}
+	// the cells analyzed before the counts were stored have no colored pixels
+	unknown := image.Point{3, 0}
+	for i := range 2 {
+		ssPath := fmt.Sprintf("%v-jaipur-x%v-y%v.png", now.Add(-time.Duration(i+1)*time.Hour).Format("20060102-150405"),
+			unknown.X, unknown.Y)
+		if _, err := db.Exec(`INSERT INTO traffic(ss_path, city) VALUES(?, ?)`, ssPath, "jaipur"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got, err := computeEmptyCells(context.Background(), db, conf, "jaipur")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[image.Point]bool{empty: true, unknown: true}
+	if len(got) != len(want) || !got[empty] || !got[unknown] {
+		t.Errorf("empty cells = %v, want %v", got, want)
+	}
+
+	// an excluded cell is included again once it has a colored pixel
+	insertTestRound(t, db, now, map[image.Point]trafficCounts{empty: {Yellow: 1}})
+	if got, err = computeEmptyCells(context.Background(), db, conf, "jaipur"); err != nil {
+		t.Fatal(err)
+	}
+	if got[empty] || !got[unknown] {
+		t.Errorf("empty cells after a colored round = %v, want only %v", got, unknown)
+	}
+}
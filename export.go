@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"time"
+)
+
+const (
+	exportFormatGeoJSON = "geojson"
+
+	exportTrafficSQL = `SELECT ts, x, y, green, yellow, red, dark_red FROM traffic
+		WHERE city = ? AND ts >= ? AND ts < ? ORDER BY ts, x, y`
+)
+
+var (
+	// accepted formats of the time range of an export
+	exportTimeLayouts = []string{time.DateTime, "2006-01-02T15:04:05", time.DateOnly}
+)
+
+type geoJSONFeatureCollection struct {
+	Type     string           `json:"type"`
+	Features []geoJSONFeature `json:"features"`
+}
+
+type geoJSONFeature struct {
+	Type       string          `json:"type"`
+	Geometry   geoJSONGeometry `json:"geometry"`
+	Properties map[string]any  `json:"properties"`
+}
+
+type geoJSONGeometry struct {
+	Type        string         `json:"type"`
+	Coordinates [][][2]float64 `json:"coordinates"`
+}
+
+// exportGroup is the traffic of a cell summed over the rounds in a group.
+type exportGroup struct {
+	x, y   int
+	ts     string
+	hour   int
+	rounds int
+	counts trafficCounts
+}
+
+// exportGeoJSON writes a FeatureCollection with a polygon for each grid cell of the
+// cities and each round in the time range [from, to), or for each hour of the day
+// if byHour is set, in which case the counts are averaged over the rounds.
+func exportGeoJSON(ctx context.Context, db *sql.DB, cities []*cityConfig, from, to string, byHour bool, out string) error {
+	fromTime, err := parseExportTime(from, time.Time{})
+	if err != nil {
+		return err
+	}
+	toTime, err := parseExportTime(to, time.Now())
+	if err != nil {
+		return err
+	}
+
+	collection := geoJSONFeatureCollection{Type: "FeatureCollection", Features: []geoJSONFeature{}}
+	for _, city := range cities {
+		features, err := exportCityFeatures(ctx, db, city, fromTime, toTime, byHour)
+		if err != nil {
+			return fmt.Errorf("error in exporting traffic of [%v]: %w", city.Name, err)
+		}
+		collection.Features = append(collection.Features, features...)
+	}
+
+	var w io.Writer = os.Stdout
+	if out != "" && out != "-" {
+		f, err := os.Create(out)
+		if err != nil {
+			return fmt.Errorf("error in creating export file [%v]: %w", out, err)
+		}
+		defer func() {
+			if err := f.Close(); err != nil {
+				log.Printf("error in closing export file [%v]: %v", out, err)
+			}
+		}()
+		w = f
+	}
+
+	if err := json.NewEncoder(w).Encode(collection); err != nil {
+		return fmt.Errorf("error in encoding geojson: %w", err)
+	}
+	log.Printf("exported [%v] features", len(collection.Features))
+	return nil
+}
+
+func parseExportTime(value string, defaultTime time.Time) (time.Time, error) {
+	if value == "" {
+		return defaultTime, nil
+	}
+	for _, layout := range exportTimeLayouts {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid time [%v], expected YYYY-MM-DD or YYYY-MM-DD HH:MM:SS", value)
+}
+
+func exportCityFeatures(ctx context.Context, db *sql.DB, city *cityConfig, from, to time.Time, byHour bool) ([]geoJSONFeature, error) {
+	rows, err := db.QueryContext(ctx, exportTrafficSQL, city.Name, from.Format(time.DateTime), to.Format(time.DateTime))
+	if err != nil {
+		return nil, fmt.Errorf("error in querying traffic: %w", err)
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			log.Printf("error in closing rows: %v", err)
+		}
+	}()
+
+	type groupKey struct {
+		x, y int
+		key  string
+	}
+	groups := make(map[groupKey]*exportGroup)
+	for rows.Next() {
+		var ts string
+		var x, y, yellow, red, darkRed int
+		// rows analyzed before green was counted have it as NULL
+		var green sql.NullInt64
+		if err := rows.Scan(&ts, &x, &y, &green, &yellow, &red, &darkRed); err != nil {
+			return nil, fmt.Errorf("error scanning sqlite row: %w", err)
+		}
+
+		t, err := time.Parse(time.DateTime, ts)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timestamp [%v]: %w", ts, err)
+		}
+		key := groupKey{x, y, ts}
+		if byHour {
+			key.key = fmt.Sprint(t.Hour())
+		}
+
+		group, ok := groups[key]
+		if !ok {
+			group = &exportGroup{x: x, y: y, ts: ts, hour: t.Hour()}
+			groups[key] = group
+		}
+		group.rounds++
+		group.counts.Green += int(green.Int64)
+		group.counts.Yellow += yellow
+		group.counts.Red += red
+		group.counts.DarkRed += darkRed
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("sqlite rows iteration error: %w", err)
+	}
+
+	cells := make(map[[2]int]gridCell)
+	for _, cell := range city.cells() {
+		cells[[2]int{cell.X, cell.Y}] = cell
+	}
+
+	sorted := make([]*exportGroup, 0, len(groups))
+	for _, group := range groups {
+		sorted = append(sorted, group)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		a, b := sorted[i], sorted[j]
+		if byHour && a.hour != b.hour {
+			return a.hour < b.hour
+		}
+		if !byHour && a.ts != b.ts {
+			return a.ts < b.ts
+		}
+		if a.x != b.x {
+			return a.x < b.x
+		}
+		return a.y < b.y
+	})
+
+	var features []geoJSONFeature
+	for _, group := range sorted {
+		cell, ok := cells[[2]int{group.x, group.y}]
+		if !ok {
+			// the grid of the city has changed since the round
+			continue
+		}
+
+		avg := func(count int) float64 {
+			return float64(count) / float64(group.rounds)
+		}
+		properties := map[string]any{
+			"city":       city.Name,
+			"x":          group.x,
+			"y":          group.y,
+			"green":      avg(group.counts.Green),
+			"yellow":     avg(group.counts.Yellow),
+			"red":        avg(group.counts.Red),
+			"dark_red":   avg(group.counts.DarkRed),
+			"congestion": group.counts.congestion(),
+		}
+		if byHour {
+			properties["hour"] = group.hour
+			properties["rounds"] = group.rounds
+		} else {
+			properties["ts"] = group.ts
+		}
+
+		features = append(features, geoJSONFeature{
+			Type:       "Feature",
+			Geometry:   cellPolygon(city, cell),
+			Properties: properties,
+		})
+	}
+
+	return features, nil
+}
+
+// cellPolygon is the area of the cropped region of the cell, which is shifted away
+// from the centre of the screenshot by the margins. The ring is counterclockwise
+// as per RFC 7946.
+func cellPolygon(city *cityConfig, cell gridCell) geoJSONGeometry {
+	north, west, south, east := newGeoTransform(city, cell.Latitude, cell.Longitude).bounds()
+
+	return geoJSONGeometry{
+		Type: "Polygon",
+		Coordinates: [][][2]float64{{
+			{west, north}, {west, south}, {east, south}, {east, north}, {west, north},
+		}},
+	}
+}
@@ -0,0 +1,22 @@
+package main
+
+import "testing"
+
+func TestCellPolygonIsCroppedRegion(t *testing.T) {
+	city := defaultConfig().Cities[0]
+	cell := city.cells()[0]
+	geo := newGeoTransform(city, cell.Latitude, cell.Longitude)
+	north, west := geo.pixelToLatLong(0, 0)
+	south, east := geo.pixelToLatLong(imageWidthWithLeaveOuts, imageHeightWithLeaveOuts)
+
+	want := [][2]float64{{west, north}, {west, south}, {east, south}, {east, north}, {west, north}}
+	ring := cellPolygon(city, cell).Coordinates[0]
+	if len(ring) != len(want) {
+		t.Fatalf("polygon has [%v] points, want %v", len(ring), len(want))
+	}
+	for i := range want {
+		if ring[i] != want[i] {
+			t.Errorf("point %v of polygon = %v, want %v", i, ring[i], want[i])
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"math"
+)
+
+const (
+	// radius of the sphere used by Web Mercator, metersPerDegree is a degree along it
+	earthRadiusMeters = 6378137
+
+	// ground resolution per meter of zoom in the maps URL, the cropped region is
+	// 1800 meters wide at a zoom of 1200 meters and scales with the zoom
+	metersPerPixelPerZoomMeter = 1800.0 / imageWidthWithLeaveOuts / 1200
+
+	// the tile size of a city can be off from the cropped region at its zoom by this
+	// fraction, the cells overlap or leave gaps between them by as much
+	maxTileSizeError = 0.1
+)
+
+// geoTransform maps the pixels of the cropped region of a cell to coordinates. The
+// screenshot is a Web Mercator projection centred at the coordinates of the cell,
+// and is cropped by the imageToLeaveOn* margins which shifts the cropped region
+// away from the centre. The zoom in the maps URL gives the ground resolution of the
+// cell, the tile size of the city is checked to match the cropped region at the zoom.
+type geoTransform struct {
+	// coordinates at the centre of the screenshot
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+	// ground resolution at the centre, the Web Mercator scale grows as 1/cos(latitude)
+	MetersPerPixel float64 `json:"meters_per_pixel"`
+}
+
+func newGeoTransform(city *cityConfig, latitude, longitude float64) geoTransform {
+	return geoTransform{
+		Latitude:       latitude,
+		Longitude:      longitude,
+		MetersPerPixel: zoomMetersPerPixel(city.ZoomMeters),
+	}
+}
+
+// zoomMetersPerPixel is the ground resolution of a screenshot at the zoom in the maps URL.
+func zoomMetersPerPixel(zoomMeters int) float64 {
+	return float64(zoomMeters) * metersPerPixelPerZoomMeter
+}
+
+// mercatorMetersPerPixel is the scale of the projection in Web Mercator meters.
+func (t geoTransform) mercatorMetersPerPixel() float64 {
+	return t.MetersPerPixel / math.Cos(t.Latitude*math.Pi/180)
+}
+
+// pixelToLatLong returns the coordinates of a pixel of the cropped region of the cell.
+// The pixel can be fractional, the centre of the pixel (x, y) is at (x+0.5, y+0.5).
+func (t geoTransform) pixelToLatLong(px, py float64) (float64, float64) {
+	scale := t.mercatorMetersPerPixel()
+	mx, my := mercator(t.Latitude, t.Longitude)
+	mx += (px + imageToLeaveOnLeft - imageWidth/2) * scale
+	my -= (py + imageToLeaveOnTop - imageHeight/2) * scale
+	return inverseMercator(mx, my)
+}
+
+// latLongToPixel returns the pixel of the cropped region of the cell at the
+// coordinates, which is outside the cropped region if the cell does not cover it.
+func (t geoTransform) latLongToPixel(latitude, longitude float64) (float64, float64) {
+	scale := t.mercatorMetersPerPixel()
+	cx, cy := mercator(t.Latitude, t.Longitude)
+	mx, my := mercator(latitude, longitude)
+	px := (mx-cx)/scale - imageToLeaveOnLeft + imageWidth/2
+	py := (cy-my)/scale - imageToLeaveOnTop + imageHeight/2
+	return px, py
+}
+
+// bounds returns the coordinates of the north west and the south east
+// corners of the cropped region of the cell.
+func (t geoTransform) bounds() (north, west, south, east float64) {
+	north, west = t.pixelToLatLong(0, 0)
+	south, east = t.pixelToLatLong(imageWidthWithLeaveOuts, imageHeightWithLeaveOuts)
+	return north, west, south, east
+}
+
+func mercator(latitude, longitude float64) (float64, float64) {
+	x := earthRadiusMeters * longitude * math.Pi / 180
+	y := earthRadiusMeters * math.Log(math.Tan(math.Pi/4+latitude*math.Pi/360))
+	return x, y
+}
+
+func inverseMercator(x, y float64) (float64, float64) {
+	latitude := (2*math.Atan(math.Exp(y/earthRadiusMeters)) - math.Pi/2) * 180 / math.Pi
+	longitude := x / earthRadiusMeters * 180 / math.Pi
+	return latitude, longitude
+}
+
+// combinedPixelToLatLong returns the coordinates of a pixel of the combined
+// screenshot or mask of the round, using the geo transform of its cell.
+func (m *captureManifest) combinedPixelToLatLong(px, py float64) (float64, float64, error) {
+	x, y := int(px)/imageWidthWithLeaveOuts, int(py)/imageHeightWithLeaveOuts
+	cell := m.cell(x, y)
+	if px < 0 || py < 0 || cell == nil {
+		return 0, 0, fmt.Errorf("pixel [%v, %v] is outside the grid of [%v]", px, py, m.Prefix)
+	}
+	if cell.Geo.MetersPerPixel == 0 {
+		return 0, 0, fmt.Errorf("manifest [%v] has no geo transform for cell [%v, %v]", m.Prefix, x, y)
+	}
+
+	lat, long := cell.Geo.pixelToLatLong(px-float64(x*imageWidthWithLeaveOuts), py-float64(y*imageHeightWithLeaveOuts))
+	return lat, long, nil
+}
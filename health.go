@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	stageCapture = "capture"
+	stageSync    = "sync"
+)
+
+// healthConfig defines when a stage of the pipeline is considered stale.
+type healthConfig struct {
+	// the capture is stale if no round succeeded for this long,
+	// not counting the time in which the schedule has no round
+	CaptureStaleMinutes int `json:"capture_stale_minutes"`
+	// the sync is stale if a round captured this long ago is not synced yet
+	SyncStaleMinutes int `json:"sync_stale_minutes"`
+}
+
+func defaultHealthConfig() healthConfig {
+	return healthConfig{
+		CaptureStaleMinutes: 60,
+		SyncStaleMinutes:    30,
+	}
+}
+
+// pipelineHealth tracks the goroutines of the periodic pipeline. A stage is
+// registered when its goroutine starts, the goroutine reports its progress.
+type pipelineHealth struct {
+	mu     sync.Mutex
+	stages map[string]*stageHealth
+}
+
+type stageHealth struct {
+	Alive       bool      `json:"alive"`
+	StartedAt   time.Time `json:"started_at"`
+	LastSuccess time.Time `json:"last_success,omitzero"`
+	IdleUntil   time.Time `json:"idle_until,omitzero"`
+	LastError   string    `json:"last_error,omitempty"`
+	Restarts    int       `json:"restarts"`
+	Stale       bool      `json:"stale"`
+}
+
+type healthReport struct {
+	Status string                  `json:"status"`
+	Stages map[string]*stageHealth `json:"stages"`
+	Error  string                  `json:"error,omitempty"`
+}
+
+// pipeline is the health of the pipeline run by runPeriodicSync.
+var pipeline = newPipelineHealth()
+
+func newPipelineHealth() *pipelineHealth {
+	return &pipelineHealth{stages: make(map[string]*stageHealth)}
+}
+
+// start registers the stage as alive, keeping its history if it is restarted.
+func (p *pipelineHealth) start(stage string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s, ok := p.stages[stage]
+	if !ok {
+		s = &stageHealth{}
+		p.stages[stage] = s
+	}
+	s.Alive = true
+	s.StartedAt = time.Now()
+}
+
+func (p *pipelineHealth) stop(stage string) {
+	p.update(stage, func(s *stageHealth) { s.Alive = false })
+}
+
+func (p *pipelineHealth) success(stage string) {
+	p.update(stage, func(s *stageHealth) {
+		s.LastSuccess = time.Now()
+		s.LastError = ""
+	})
+}
+
+// idleUntil records that the stage has nothing to do until the given time,
+// which keeps it from going stale till then.
+func (p *pipelineHealth) idleUntil(stage string, until time.Time) {
+	p.update(stage, func(s *stageHealth) { s.IdleUntil = until })
+}
+
+func (p *pipelineHealth) restarted(stage string, err error) {
+	p.update(stage, func(s *stageHealth) {
+		s.Restarts++
+		s.LastError = err.Error()
+	})
+}
+
+func (p *pipelineHealth) failure(stage string, err error) {
+	p.update(stage, func(s *stageHealth) { s.LastError = err.Error() })
+}
+
+func (p *pipelineHealth) update(stage string, fn func(s *stageHealth)) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if s, ok := p.stages[stage]; ok {
+		fn(s)
+	}
+}
+
+// report returns a copy of the stages with their staleness, and whether all
+// the stages are alive and whether none of them is stale.
+func (p *pipelineHealth) report(conf healthConfig) (map[string]*stageHealth, bool, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	stages := make(map[string]*stageHealth, len(p.stages))
+	alive, fresh := true, true
+	for name, s := range p.stages {
+		stage := *s
+		switch name {
+		case stageCapture:
+			last := latestTime(stage.StartedAt, stage.LastSuccess, stage.IdleUntil)
+			stage.Stale = now.Sub(last) > time.Duration(conf.CaptureStaleMinutes)*time.Minute
+		case stageSync:
+			if capture, ok := p.stages[stageCapture]; ok && capture.LastSuccess.After(stage.LastSuccess) {
+				stage.Stale = now.Sub(capture.LastSuccess) > time.Duration(conf.SyncStaleMinutes)*time.Minute
+			}
+		}
+
+		alive = alive && stage.Alive
+		fresh = fresh && !stage.Stale
+		stages[name] = &stage
+	}
+	return stages, alive, fresh
+}
+
+func latestTime(times ...time.Time) time.Time {
+	var latest time.Time
+	for _, t := range times {
+		if t.After(latest) {
+			latest = t
+		}
+	}
+	return latest
+}
+
+// registerHealth adds the health checks to the mux of the dashboard or the metrics server.
+func (s *dashboardServer) registerHealth(mux *http.ServeMux) {
+	mux.HandleFunc("GET /healthz", s.handleHealthz)
+	mux.HandleFunc("GET /readyz", s.handleReadyz)
+}
+
+// handleHealthz fails if a goroutine of the pipeline has exited.
+func (s *dashboardServer) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	stages, alive, _ := pipeline.report(s.health)
+	report := healthReport{Status: "ok", Stages: stages}
+	if !alive {
+		report.Status = "dead"
+		writeHealth(w, http.StatusServiceUnavailable, report)
+		return
+	}
+	writeHealth(w, http.StatusOK, report)
+}
+
+// handleReadyz fails if a goroutine of the pipeline has exited, a stage
+// is stale, or the database is not reachable.
+func (s *dashboardServer) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	stages, alive, fresh := pipeline.report(s.health)
+	report := healthReport{Status: "ok", Stages: stages}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+	if err := s.db.PingContext(ctx); err != nil {
+		report.Error = err.Error()
+	}
+
+	switch {
+	case !alive:
+		report.Status = "dead"
+	case !fresh:
+		report.Status = "stale"
+	case report.Error != "":
+		report.Status = "db unavailable"
+	default:
+		writeHealth(w, http.StatusOK, report)
+		return
+	}
+	writeHealth(w, http.StatusServiceUnavailable, report)
+}
+
+func writeHealth(w http.ResponseWriter, code int, report healthReport) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	writeJSON(w, report)
+}
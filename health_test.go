@@ -0,0 +1,141 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestPipelineHealthReport(t *testing.T) {
+	now := time.Now()
+	ago := func(minutes int) time.Time { return now.Add(-time.Duration(minutes) * time.Minute) }
+	conf := healthConfig{CaptureStaleMinutes: 60, SyncStaleMinutes: 30}
+
+	tests := []struct {
+		name      string
+		stages    map[string]*stageHealth
+		wantStale map[string]bool
+		wantAlive bool
+	}{
+		{
+			name: "fresh capture and sync",
+			stages: map[string]*stageHealth{
+				stageCapture: {Alive: true, StartedAt: ago(300), LastSuccess: ago(10)},
+				stageSync:    {Alive: true, StartedAt: ago(300), LastSuccess: ago(5)},
+			},
+			wantStale: map[string]bool{stageCapture: false, stageSync: false},
+			wantAlive: true,
+		},
+		{
+			name: "stale capture",
+			stages: map[string]*stageHealth{
+				stageCapture: {Alive: true, StartedAt: ago(300), LastSuccess: ago(90)},
+			},
+			wantStale: map[string]bool{stageCapture: true},
+			wantAlive: true,
+		},
+		{
+			name: "capture without any round since it started",
+			stages: map[string]*stageHealth{
+				stageCapture: {Alive: true, StartedAt: ago(20)},
+			},
+			wantStale: map[string]bool{stageCapture: false},
+			wantAlive: true,
+		},
+		{
+			name: "capture idle until the next window",
+			stages: map[string]*stageHealth{
+				stageCapture: {Alive: true, StartedAt: ago(600), LastSuccess: ago(480), IdleUntil: now.Add(time.Hour)},
+			},
+			wantStale: map[string]bool{stageCapture: false},
+			wantAlive: true,
+		},
+		{
+			name: "capture idle since a window that started long ago",
+			stages: map[string]*stageHealth{
+				stageCapture: {Alive: true, StartedAt: ago(600), LastSuccess: ago(480), IdleUntil: ago(90)},
+			},
+			wantStale: map[string]bool{stageCapture: true},
+			wantAlive: true,
+		},
+		{
+			name: "stale sync",
+			stages: map[string]*stageHealth{
+				stageCapture: {Alive: true, StartedAt: ago(300), LastSuccess: ago(40)},
+				stageSync:    {Alive: true, StartedAt: ago(300), LastSuccess: ago(60)},
+			},
+			wantStale: map[string]bool{stageCapture: false, stageSync: true},
+			wantAlive: true,
+		},
+		{
+			name: "sync behind a recent round",
+			stages: map[string]*stageHealth{
+				stageCapture: {Alive: true, StartedAt: ago(300), LastSuccess: ago(10)},
+				stageSync:    {Alive: true, StartedAt: ago(300), LastSuccess: ago(60)},
+			},
+			wantStale: map[string]bool{stageCapture: false, stageSync: false},
+			wantAlive: true,
+		},
+		{
+			name: "exited stage",
+			stages: map[string]*stageHealth{
+				stageCapture: {Alive: true, StartedAt: ago(300), LastSuccess: ago(10)},
+				stageSync:    {Alive: false, StartedAt: ago(300), LastSuccess: ago(5), Restarts: 1},
+			},
+			wantStale: map[string]bool{stageCapture: false, stageSync: false},
+			wantAlive: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newPipelineHealth()
+			p.stages = tt.stages
+			stages, alive, fresh := p.report(conf)
+			if alive != tt.wantAlive {
+				t.Errorf("alive = %v, want %v", alive, tt.wantAlive)
+			}
+			wantFresh := true
+			for name, want := range tt.wantStale {
+				if stages[name].Stale != want {
+					t.Errorf("stale of [%v] = %v, want %v", name, stages[name].Stale, want)
+				}
+				wantFresh = wantFresh && !want
+			}
+			if fresh != wantFresh {
+				t.Errorf("fresh = %v, want %v", fresh, wantFresh)
+			}
+		})
+	}
+}
+
+func TestPipelineHealthRestartedStage(t *testing.T) {
+	conf := healthConfig{CaptureStaleMinutes: 60, SyncStaleMinutes: 30}
+	p := newPipelineHealth()
+	p.start(stageCapture)
+	p.success(stageCapture)
+
+	p.stop(stageCapture)
+	p.restarted(stageCapture, errors.New("boom"))
+	stages, alive, _ := p.report(conf)
+	if alive {
+		t.Error("pipeline is alive while the capture waits to restart")
+	}
+	if s := stages[stageCapture]; s.Restarts != 1 || s.LastError != "boom" {
+		t.Errorf("capture has [%v] restarts and error [%v], want 1 and boom", s.Restarts, s.LastError)
+	}
+
+	// the history is kept across the restart, the last error until the next success
+	p.start(stageCapture)
+	stages, alive, fresh := p.report(conf)
+	if !alive || !fresh {
+		t.Errorf("alive = %v and fresh = %v after restart, want both", alive, fresh)
+	}
+	if s := stages[stageCapture]; s.Restarts != 1 || s.LastError != "boom" || s.LastSuccess.IsZero() {
+		t.Errorf("capture after restart = %+v, want its history", s)
+	}
+	p.success(stageCapture)
+	if stages, _, _ := p.report(conf); stages[stageCapture].LastError != "" {
+		t.Errorf("last error after success = %v, want none", stages[stageCapture].LastError)
+	}
+}
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"flag"
 	"fmt"
 	"io/fs"
@@ -11,7 +13,6 @@ import (
 	"path/filepath"
 	"sort"
 	"strings"
-	"sync"
 	"time"
 
 	"golang.org/x/sys/unix"
@@ -19,7 +20,6 @@ import (
 
 const (
 	tmpRodFolder = "/tmp/rod"
-	ssTimePeriod = 10 * time.Minute
 )
 
 var (
@@ -29,6 +29,9 @@ var (
 	ssCombFolder   = "ss-comb"
 	maskCombFolder = "mask-comb"
 	isolateFolder  = "ss-iso"
+	manifestFolder = "manifest"
+	roadMaskFolder = "road-mask"
+	segmentFolder  = "segment"
 )
 
 func main() {
@@ -38,10 +41,32 @@ func main() {
 	ssCombFolderVar := flag.String("ss-comb-folder", "", "directory storing combined screenshots")
 	maskCombFolderVar := flag.String("mask-comb-folder", "", "directory storing combined masks")
 	isolateFolderVar := flag.String("isolate-folder", "", "directory storing isolated grids")
+	manifestFolderVar := flag.String("manifest-folder", "", "directory storing capture manifests")
+	roadMaskFolderVar := flag.String("road-mask-folder", "", "directory storing reference road masks")
+	segmentFolderVar := flag.String("segment-folder", "", "directory storing road segment maps")
+	configFile := flag.String("config", "", "city definition file (JSON), defaults to Jaipur")
+	cityName := flag.String("city", "", "city to operate on, defaults to all cities (first city for analyze/isolate)")
+	sourceType := flag.String("source", "", "overrides the tile source: google, replay or synthetic")
+
+	serveAddr := flag.String("serve", "", "serve the dashboard on the address e.g. :8080 while capturing periodically")
+	metricsAddr := flag.String("metrics-addr", defaultMetricsAddr, "serve the metrics and health checks on the address while capturing periodically, empty to disable")
 
 	ss := flag.Bool("ss", false, "take screenshots once and analyze")
 	analyzePrefix := flag.String("analyze", "", "analyze existing screenshots with prefix")
+	syncOnce := flag.Bool("sync", false, "sync the traffic in sqlite to postgres once and exit")
 	isolate := flag.String("isolate", "", "isolate a particular grid from the map e.g. 0,0")
+	recompute := flag.Bool("recompute", false, "recompute traffic of existing rows from the combined masks")
+	rebuildRoadMask := flag.Bool("rebuild-road-masks", false, "rebuild road masks from the combined masks")
+	roadMaskPrefix := flag.String("road-mask-prefix", "", "only use combined masks with the prefix to rebuild road masks")
+	exportFormat := flag.String("export", "", "export traffic in the format, only geojson is supported")
+	exportFrom := flag.String("from", "", "start of the time range to export e.g. 2025-01-02 or 2025-01-02 15:04:05")
+	exportTo := flag.String("to", "", "end (exclusive) of the time range to export, defaults to now")
+	exportByHour := flag.Bool("by-hour", false, "average the exported traffic by hour of the day")
+	exportOut := flag.String("out", "-", "file to export to, - for stdout")
+	scheduleCmd := flag.String("schedule", "", "preview prints the next capture times as per the schedule")
+	previewCount := flag.Int("count", 10, "number of capture times to preview")
+	calibrateFolder := flag.String("calibrate", "", "suggest palette colors using sample screenshots in the directory")
+	gracePeriod := flag.Duration("shutdown-timeout", 30*time.Second, "time to wait for the work in flight to stop on SIGINT or SIGTERM")
 	flag.Parse()
 
 	ssFolder = getNonEmpty(*ssFolderVar, ssFolder)
@@ -50,11 +75,36 @@ func main() {
 	ssCombFolder = getNonEmpty(*ssCombFolderVar, ssCombFolder)
 	maskCombFolder = getNonEmpty(*maskCombFolderVar, maskCombFolder)
 	isolateFolder = getNonEmpty(*isolateFolderVar, isolateFolder)
+	manifestFolder = getNonEmpty(*manifestFolderVar, manifestFolder)
+	roadMaskFolder = getNonEmpty(*roadMaskFolderVar, roadMaskFolder)
+	segmentFolder = getNonEmpty(*segmentFolderVar, segmentFolder)
 
 	if err := createFolders(); err != nil {
 		panic(err)
 	}
 
+	conf, err := loadConfig(*configFile)
+	if err != nil {
+		panic(err)
+	}
+	conf.Source.Type = getNonEmpty(*sourceType, conf.Source.Type)
+
+	// browsers from an earlier run that was killed are left behind
+	if err := cleanupTmpRod(); err != nil {
+		log.Printf("error in cleaning up tmp rod: %v", err)
+	}
+
+	p, err := readPalette(conf)
+	if err != nil {
+		panic(err)
+	}
+
+	source, err := newTileSource(conf.Source, p)
+	if err != nil {
+		panic(err)
+	}
+	defer source.Close()
+
 	db, closeDB, err := openDB()
 	if err != nil {
 		panic(err)
@@ -65,35 +115,132 @@ func main() {
 		panic(err)
 	}
 
-	ctrlC := make(chan os.Signal, 1)
-	signal.Notify(ctrlC, os.Interrupt)
-	defer signal.Stop(ctrlC)
+	ctx, stop := shutdownContext(*gracePeriod)
+	defer stop()
 
 	switch {
 	case *ss:
-		prefix, err := takeGridScreenshots(ctrlC)
+		cities, err := conf.cities(*cityName)
 		if err != nil {
 			panic(err)
 		}
-		if err := analyzeScreenshots(prefix, db); err != nil {
+		if err := sampling.refresh(ctx, db, conf.Sampling, cities); err != nil {
+			panic(err)
+		}
+		if err := exclusions.refresh(ctx, db, conf.Exclusion, cities); err != nil {
 			panic(err)
 		}
+		for _, city := range cities {
+			manifest, err := takeGridScreenshots(ctx, city, source, conf.Capture, roundCadence{})
+			if err != nil {
+				panic(err)
+			}
+			if err := insertCaptureRound(ctx, db, manifest); err != nil {
+				panic(err)
+			}
+			if !manifest.complete() {
+				log.Printf("not analyzing incomplete round [%v]", manifest.Prefix)
+				continue
+			}
+			if err := analyzeScreenshots(ctx, manifest, p, db); err != nil {
+				panic(err)
+			}
+		}
 
 	case *analyzePrefix != "":
-		if err := analyzeScreenshots(*analyzePrefix, db); err != nil {
+		manifest, err := readManifest(*analyzePrefix)
+		if errors.Is(err, fs.ErrNotExist) {
+			city, cityErr := conf.city(*cityName)
+			if cityErr != nil {
+				panic(cityErr)
+			}
+			manifest = rebuildManifest(city, *analyzePrefix)
+		} else if err != nil {
+			panic(err)
+		}
+		if err := analyzeScreenshots(ctx, manifest, p, db); err != nil {
+			panic(err)
+		}
+
+	case *recompute:
+		if err := recomputeTraffic(ctx, conf.Cities, *cityName, db); err != nil {
+			panic(err)
+		}
+
+	case *rebuildRoadMask:
+		cities, err := conf.cities(*cityName)
+		if err != nil {
+			panic(err)
+		}
+		for _, city := range cities {
+			if err := rebuildRoadMasks(ctx, city, *roadMaskPrefix, db); err != nil {
+				panic(err)
+			}
+		}
+
+	case *exportFormat != "":
+		if *exportFormat != exportFormatGeoJSON {
+			panic(fmt.Errorf("unknown export format [%v]", *exportFormat))
+		}
+		cities, err := conf.cities(*cityName)
+		if err != nil {
+			panic(err)
+		}
+		if err := exportGeoJSON(ctx, db, cities, *exportFrom, *exportTo, *exportByHour, *exportOut); err != nil {
+			panic(err)
+		}
+
+	case *scheduleCmd != "":
+		if *scheduleCmd != "preview" {
+			panic(fmt.Errorf("unknown schedule command [%v]", *scheduleCmd))
+		}
+		if err := previewSchedule(&conf.Schedule, time.Now(), *previewCount, os.Stdout); err != nil {
+			panic(err)
+		}
+
+	case *calibrateFolder != "":
+		if err := calibrate(*calibrateFolder, p); err != nil {
+			panic(err)
+		}
+
+	case *syncOnce:
+		if err := syncOnceToPG(ctx, db, conf.Sync); err != nil {
 			panic(err)
 		}
 
 	case *isolate != "":
-		if err := isolateGrid(isolateFolder, *isolate, ctrlC); err != nil {
+		city, err := conf.city(*cityName)
+		if err != nil {
+			panic(err)
+		}
+		if err := isolateGrid(ctx, city, isolateFolder, *isolate); err != nil {
 			panic(err)
 		}
 
 	default:
-		runPeriodicSync(ctrlC, db)
+		cities, err := conf.cities(*cityName)
+		if err != nil {
+			panic(err)
+		}
+		runPeriodicSync(ctx, db, conf, cities, source, p, *serveAddr, *metricsAddr)
 	}
 }
 
+// shutdownContext returns a context that is cancelled on SIGINT or SIGTERM. The process
+// exits if the work in flight does not stop within the grace period, or on a second signal.
+func shutdownContext(gracePeriod time.Duration) (context.Context, context.CancelFunc) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, unix.SIGTERM)
+	context.AfterFunc(ctx, func() {
+		// the default handling of the signals kills the process on a second signal
+		stop()
+		time.AfterFunc(gracePeriod, func() {
+			log.Printf("shutdown did not complete in [%v], exiting", gracePeriod)
+			os.Exit(1)
+		})
+	})
+	return ctx, stop
+}
+
 func getNonEmpty(val, defaultVal string) string {
 	if val != "" {
 		return val
@@ -120,81 +267,163 @@ func createFolders() error {
 	if err := os.MkdirAll(isolateFolder, 0755); err != nil {
 		return fmt.Errorf("error in creating isolate folder [%v]: %w", isolateFolder, err)
 	}
+	if err := os.MkdirAll(manifestFolder, 0755); err != nil {
+		return fmt.Errorf("error in creating manifest folder [%v]: %w", manifestFolder, err)
+	}
+	if err := os.MkdirAll(roadMaskFolder, 0755); err != nil {
+		return fmt.Errorf("error in creating road mask folder [%v]: %w", roadMaskFolder, err)
+	}
+	if err := os.MkdirAll(segmentFolder, 0755); err != nil {
+		return fmt.Errorf("error in creating segment folder [%v]: %w", segmentFolder, err)
+	}
 	return nil
 }
 
-func runPeriodicSync(ctrlC <-chan os.Signal, db *sql.DB) {
+// runPeriodicSync runs the capture, the sync to postgres, the metrics server and optionally
+// the dashboard under a supervisor, which restarts them if they fail, until the context
+// is cancelled.
+func runPeriodicSync(ctx context.Context, db *sql.DB, conf *config, cities []*cityConfig,
+	source TileSource, p *palette, serveAddr, metricsAddr string) {
+
 	hint := make(chan struct{}, 10)
-	quit := make(chan os.Signal, 10)
 	hint <- struct{}{}
 
-	var wg sync.WaitGroup
-	wg.Add(2)
-	go periodicSyncToPG(db, hint, quit, &wg)
-	go takePeriodicScreenshots(db, hint, quit, &wg)
+	sup := newSupervisor()
+	sup.add(stageSync, func(ctx context.Context) error {
+		return periodicSyncToPG(ctx, db, conf.Sync, hint)
+	})
+	sup.add(stageCapture, func(ctx context.Context) error {
+		return takePeriodicScreenshots(ctx, db, conf, cities, source, p, hint)
+	})
+	if metricsAddr != "" {
+		sup.add(stageMetrics, func(ctx context.Context) error {
+			return serveMetrics(ctx, metricsAddr, db, conf.Health)
+		})
+	}
+	if serveAddr != "" {
+		sup.add(stageDashboard, func(ctx context.Context) error {
+			return serveDashboard(ctx, serveAddr, db, cities, conf.Health)
+		})
+	}
+	sup.run(ctx)
+}
 
-	<-ctrlC
-	close(quit)
-	wg.Wait()
+// notifySync hints the sync to run, a pending hint is enough if there is one already.
+func notifySync(hint chan struct{}) {
+	select {
+	case hint <- struct{}{}:
+	default:
+	}
 }
 
-func takePeriodicScreenshots(db *sql.DB, hint chan struct{}, quit <-chan os.Signal, wg *sync.WaitGroup) {
-	defer wg.Done()
+func takePeriodicScreenshots(ctx context.Context, db *sql.DB, conf *config, cities []*cityConfig,
+	source TileSource, p *palette, hint chan struct{}) error {
 
-	t := time.NewTicker(ssTimePeriod)
-	defer t.Stop()
-	skipCount := 0
+	// the interval chosen by the cadence in the last round, until then the schedule is followed
+	var lastRound time.Time
+	var interval time.Duration
 	for {
+		next, err := nextRound(conf, lastRound, interval)
+		if err != nil {
+			return err
+		}
+		// the capture is not stale while it waits longer than the schedule would
+		if time.Until(next) > conf.Schedule.interval() {
+			log.Printf("next screenshot at [%v]", next.Format(time.DateTime))
+			pipeline.idleUntil(stageCapture, next)
+		}
+
+		timer := time.NewTimer(time.Until(next))
 		select {
-		case <-quit:
+		case <-ctx.Done():
+			timer.Stop()
 			log.Println("shutting down screenshot thread!")
-			return
-
-		case <-t.C:
-			currentHour := time.Now().UTC().Hour()
-			// no screenshot during 2:30 to 6:30 IST, that is 21 to 1 UTC
-			if currentHour >= 21 || currentHour <= 1 {
-				skipCount = 0
-				log.Println("skipping screenshot during 2:30AM to 6:30AM IST")
-				continue
-			}
-			// between 11:30PM to 1:30 AM, take screenshot every half an hour (every 3rd 10min tick)
-			// Note that 1:29AM has currentHour=19 in UTC, 1:30AM has currentHour=20 in UTC.
-			if currentHour == 18 || currentHour == 19 {
-				skipCount++
-				if skipCount%3 != 0 {
-					log.Printf("skipping screenshot between 11:30PM to 1:30AM IST (skipCount: %d)", skipCount)
-					continue
-				}
-				skipCount = 0 // reset after taking a screenshot
-			}
+			return nil
 
+		case <-timer.C:
 			if err := makeSpaceIfNeeded(); err != nil {
 				log.Println(err)
+				pipeline.failure(stageCapture, err)
 				continue
 			}
 
-			prefix, err := takeGridScreenshots(quit)
-			if err != nil {
+			if err := sampling.refresh(ctx, db, conf.Sampling, cities); err != nil {
 				log.Println(err)
-				return // because this means ctrl+c is pressed
 			}
-
-			if err := analyzeScreenshots(prefix, db); err != nil {
+			if err := exclusions.refresh(ctx, db, conf.Exclusion, cities); err != nil {
 				log.Println(err)
-				continue
 			}
 
-			if err := deleteScreenshots(prefix); err != nil {
-				log.Println(err)
-				continue
+			lastRound, interval = next, 0
+			for _, city := range cities {
+				cadence := cityCadence(ctx, db, conf, city.Name, next)
+				if interval == 0 || cadence.Interval < interval {
+					interval = cadence.Interval
+				}
+
+				manifest, err := takeGridScreenshots(ctx, city, source, conf.Capture, cadence)
+				if err != nil {
+					return err
+				}
+
+				if err := insertCaptureRound(ctx, db, manifest); err != nil {
+					log.Println(err)
+				}
+
+				if !manifest.complete() {
+					log.Printf("not analyzing incomplete round [%v]", manifest.Prefix)
+					pipeline.failure(stageCapture, fmt.Errorf("incomplete round [%v]", manifest.Prefix))
+					if err := deleteScreenshots(manifest.Prefix); err != nil {
+						log.Println(err)
+					}
+					continue
+				}
+
+				if err := analyzeScreenshots(ctx, manifest, p, db); err != nil {
+					log.Println(err)
+					pipeline.failure(stageCapture, err)
+					continue
+				}
+				pipeline.success(stageCapture)
+
+				if err := deleteScreenshots(manifest.Prefix); err != nil {
+					log.Println(err)
+					continue
+				}
 			}
 
-			hint <- struct{}{}
+			notifySync(hint)
 		}
 	}
 }
 
+// nextRound returns the time of the next round, which is after the interval chosen by the
+// adaptive cadence, or as per the schedule if the cadence is fixed or there is no last round.
+func nextRound(conf *config, lastRound time.Time, interval time.Duration) (time.Time, error) {
+	if !conf.Cadence.Adaptive || lastRound.IsZero() {
+		return conf.Schedule.next(time.Now())
+	}
+	return conf.Schedule.nextAfter(lastRound, interval)
+}
+
+// cityCadence chooses the cadence of the round of the city, it falls
+// back to the interval of the schedule if the trend is not known.
+func cityCadence(ctx context.Context, db *sql.DB, conf *config, city string, now time.Time) roundCadence {
+	base, on := conf.Schedule.intervalAt(now)
+	if !on {
+		base = conf.Schedule.interval()
+	}
+
+	cadence, err := chooseCadence(ctx, db, conf.Cadence, city, base, now)
+	if err != nil {
+		log.Printf("error in choosing cadence of %v: %v", city, err)
+	}
+	log.Printf("next round of %v in [%v] (cadence: %v), [%v] cells with rising congestion",
+		city, cadence.Interval, cadence.Reason, len(cadence.hotCells))
+	captureInterval.WithLabelValues(city).Set(cadence.Interval.Seconds())
+	return cadence
+}
+
 func deleteScreenshots(prefix string) error {
 	log.Printf("deleting screenshots with prefix [%v]...", prefix)
 
@@ -215,7 +444,8 @@ func deleteScreenshots(prefix string) error {
 			return nil
 		}
 
-		if err := os.Remove(filepath.Join(maskFolder, info.Name())); err != nil {
+		// masks are not computed for incomplete rounds
+		if err := os.Remove(filepath.Join(maskFolder, info.Name())); err != nil && !errors.Is(err, fs.ErrNotExist) {
 			return fmt.Errorf("error in removing mask [%v]: %w", info.Name(), err)
 		}
 		if err := os.Remove(ssPath); err != nil {
@@ -230,15 +460,12 @@ func cleanupTmpRod() error {
 }
 
 func makeSpaceIfNeeded() error {
-	if err := cleanupTmpRod(); err != nil {
-		log.Printf("error in cleaning up tmp rod: %v", err)
-	}
-
 	var stat unix.Statfs_t
 	if err := unix.Statfs(ssCombFolder, &stat); err != nil {
 		return fmt.Errorf("error in getting disk stats for [%v]: %w", ssCombFolder, err)
 	}
 
+	diskFreeBytes.Set(float64(uint64(stat.Bavail) * uint64(stat.Bsize)))
 	availableSpace := uint64(stat.Bavail) * uint64(stat.Bsize) / 1024 / 1024 / 1024
 	log.Printf("available space: %vGB", availableSpace)
 	if availableSpace > 5 {
@@ -272,5 +499,9 @@ func makeSpaceIfNeeded() error {
 	if err := os.Remove(filepath.Join(maskCombFolder, fileToDelete)); err != nil {
 		return fmt.Errorf("failed to delete file %s: %w", fileToDelete, err)
 	}
+	manifestFile := manifestPath(strings.TrimSuffix(fileToDelete, ".png"))
+	if err := os.Remove(manifestFile); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to delete file %s: %w", manifestFile, err)
+	}
 	return nil
 }
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+const (
+	manifestFileNameFmt = "%v/%v.json"
+
+	cellStatusPending  = "pending"
+	cellStatusCaptured = "captured"
+	cellStatusSkipped  = "skipped"
+	cellStatusFailed   = "failed"
+	cellStatusExcluded = "excluded"
+
+	roundStatusComplete   = "complete"
+	roundStatusIncomplete = "incomplete"
+)
+
+// captureManifest records the plan and the outcome of a capture round. It is the
+// single source of truth for the grid used in analyzing, combining and isolating.
+type captureManifest struct {
+	City      string          `json:"city"`
+	Prefix    string          `json:"prefix"`
+	Timestamp time.Time       `json:"timestamp"`
+	NumCols   int             `json:"num_cols"`
+	NumRows   int             `json:"num_rows"`
+	Status    string          `json:"status"`
+	Coverage  float64         `json:"coverage"`
+	Cells     []*manifestCell `json:"cells"`
+
+	// minutes until the next round as chosen by the cadence, 0 if not captured periodically
+	IntervalMinutes int `json:"interval_minutes,omitempty"`
+}
+
+type manifestCell struct {
+	X          int       `json:"x"`
+	Y          int       `json:"y"`
+	Latitude   float64   `json:"latitude"`
+	Longitude  float64   `json:"longitude"`
+	URL        string    `json:"url"`
+	CapturedAt time.Time `json:"captured_at,omitzero"`
+	Status     string    `json:"status"`
+	Retries    int       `json:"retries"`
+	Error      string    `json:"error,omitempty"`
+
+	TimeToReadyMillis int64        `json:"time_to_ready_millis"`
+	Geo               geoTransform `json:"geo"`
+}
+
+func newCaptureManifest(city *cityConfig, prefix string, now time.Time) *captureManifest {
+	m := &captureManifest{
+		City:      city.Name,
+		Prefix:    prefix,
+		Timestamp: now,
+	}
+
+	for _, cell := range city.cells() {
+		m.NumCols = max(m.NumCols, cell.X+1)
+		m.NumRows = max(m.NumRows, cell.Y+1)
+		m.Cells = append(m.Cells, &manifestCell{
+			X:         cell.X,
+			Y:         cell.Y,
+			Latitude:  cell.Latitude,
+			Longitude: cell.Longitude,
+			URL:       fmt.Sprintf(mapsURLForTraffic, cell.Latitude, cell.Longitude, city.ZoomMeters),
+			Status:    cellStatusPending,
+			Geo:       newGeoTransform(city, cell.Latitude, cell.Longitude),
+		})
+	}
+
+	return m
+}
+
+// rebuildManifest creates a manifest for screenshots taken without one,
+// a cell is considered captured if its screenshot exists on disk.
+func rebuildManifest(city *cityConfig, prefix string) *captureManifest {
+	m := newCaptureManifest(city, prefix, time.Now())
+	for _, cell := range m.Cells {
+		if _, err := os.Stat(m.ssPath(cell)); err == nil {
+			cell.Status = cellStatusCaptured
+		} else {
+			cell.Status = cellStatusFailed
+			cell.Error = err.Error()
+		}
+	}
+	m.updateStatus(0)
+	return m
+}
+
+func manifestPath(prefix string) string {
+	return fmt.Sprintf(manifestFileNameFmt, manifestFolder, prefix)
+}
+
+func readManifest(prefix string) (*captureManifest, error) {
+	path := manifestPath(prefix)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error in reading manifest [%v]: %w", path, err)
+	}
+
+	var m captureManifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("error in parsing manifest [%v]: %w", path, err)
+	}
+	return &m, nil
+}
+
+func (m *captureManifest) save() error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error in encoding manifest [%v]: %w", m.Prefix, err)
+	}
+
+	path := manifestPath(m.Prefix)
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return fmt.Errorf("error in writing manifest [%v]: %w", path, err)
+	}
+	return nil
+}
+
+func (m *captureManifest) ssPath(cell *manifestCell) string {
+	return fmt.Sprintf(fileNameFmt, ssFolder, m.Prefix, cell.X, cell.Y)
+}
+
+func (m *captureManifest) maskPath(cell *manifestCell) string {
+	return fmt.Sprintf(fileNameFmt, maskFolder, m.Prefix, cell.X, cell.Y)
+}
+
+// cell returns the cell at x, y in the grid, nil if there is none.
+func (m *captureManifest) cell(x, y int) *manifestCell {
+	for _, cell := range m.Cells {
+		if cell.X == x && cell.Y == y {
+			return cell
+		}
+	}
+	return nil
+}
+
+// capturedCells returns the cells for which a screenshot was taken in the round.
+func (m *captureManifest) capturedCells() []*manifestCell {
+	var cells []*manifestCell
+	for _, cell := range m.Cells {
+		if cell.Status == cellStatusCaptured {
+			cells = append(cells, cell)
+		}
+	}
+	return cells
+}
+
+// updateStatus computes the coverage of the round, i.e. the fraction of cells captured
+// out of the cells that were not skipped or excluded, and marks the round incomplete if too low.
+func (m *captureManifest) updateStatus(minCoverage float64) {
+	var captured, attempted int
+	for _, cell := range m.Cells {
+		switch cell.Status {
+		case cellStatusCaptured:
+			captured++
+			attempted++
+		case cellStatusSkipped, cellStatusExcluded:
+		default:
+			attempted++
+		}
+	}
+
+	m.Coverage = 1
+	if attempted > 0 {
+		m.Coverage = float64(captured) / float64(attempted)
+	}
+
+	m.Status = roundStatusComplete
+	if m.Coverage < minCoverage {
+		m.Status = roundStatusIncomplete
+	}
+}
+
+func (m *captureManifest) complete() bool {
+	return m.Status == roundStatusComplete
+}
@@ -0,0 +1,72 @@
+package main
+
+import "testing"
+
+func TestManifestUpdateStatus(t *testing.T) {
+	tests := []struct {
+		name         string
+		statuses     []string
+		minCoverage  float64
+		wantCoverage float64
+		wantStatus   string
+	}{
+		{
+			name:         "all captured",
+			statuses:     []string{cellStatusCaptured, cellStatusCaptured},
+			minCoverage:  0.9,
+			wantCoverage: 1,
+			wantStatus:   roundStatusComplete,
+		},
+		{
+			name:         "at the min coverage",
+			statuses:     []string{cellStatusCaptured, cellStatusCaptured, cellStatusCaptured, cellStatusFailed},
+			minCoverage:  0.75,
+			wantCoverage: 0.75,
+			wantStatus:   roundStatusComplete,
+		},
+		{
+			name:         "below the min coverage",
+			statuses:     []string{cellStatusCaptured, cellStatusFailed, cellStatusPending, cellStatusCaptured},
+			minCoverage:  0.75,
+			wantCoverage: 0.5,
+			wantStatus:   roundStatusIncomplete,
+		},
+		{
+			name: "skipped and excluded cells are not attempted",
+			statuses: []string{cellStatusCaptured, cellStatusCaptured, cellStatusCaptured, cellStatusFailed,
+				cellStatusSkipped, cellStatusExcluded, cellStatusSkipped},
+			minCoverage:  0.75,
+			wantCoverage: 0.75,
+			wantStatus:   roundStatusComplete,
+		},
+		{
+			name:         "no cell attempted",
+			statuses:     []string{cellStatusSkipped, cellStatusExcluded},
+			minCoverage:  0.9,
+			wantCoverage: 1,
+			wantStatus:   roundStatusComplete,
+		},
+		{
+			name:         "none captured",
+			statuses:     []string{cellStatusFailed, cellStatusFailed},
+			minCoverage:  0.9,
+			wantCoverage: 0,
+			wantStatus:   roundStatusIncomplete,
+		},
+	}
+
+	for _, tt := range tests {
+		m := &captureManifest{}
+		for i, status := range tt.statuses {
+			m.Cells = append(m.Cells, &manifestCell{X: i, Status: status})
+		}
+		m.updateStatus(tt.minCoverage)
+		if m.Coverage != tt.wantCoverage || m.Status != tt.wantStatus {
+			t.Errorf("%v: coverage and status = %v %v, want %v %v", tt.name, m.Coverage, m.Status,
+				tt.wantCoverage, tt.wantStatus)
+		}
+		if m.complete() != (tt.wantStatus == roundStatusComplete) {
+			t.Errorf("%v: complete = %v with status %v", tt.name, m.complete(), m.Status)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const (
+	defaultMetricsAddr = ":9090"
+	stageMetrics       = "metrics"
+)
+
+// metrics are registered with the default prometheus registry and are served on /metrics
+// of the metrics server, and of the dashboard server.
+var (
+	tilesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "tdash_tiles_total",
+		Help: "Tiles processed in capture rounds by status: captured, failed, skipped or excluded.",
+	}, []string{"city", "status"})
+
+	captureRoundsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "tdash_capture_rounds_total",
+		Help: "Capture rounds by status: complete or incomplete.",
+	}, []string{"city", "status"})
+
+	captureDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "tdash_capture_round_duration_seconds",
+		Help:    "Time taken to capture all the tiles of a round.",
+		Buckets: prometheus.ExponentialBuckets(30, 2, 8),
+	}, []string{"city"})
+
+	captureInterval = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "tdash_capture_interval_seconds",
+		Help: "Interval until the next round chosen by the cadence of the city.",
+	}, []string{"city"})
+
+	analysisDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "tdash_analysis_duration_seconds",
+		Help:    "Time taken to analyze the screenshots of a round.",
+		Buckets: prometheus.ExponentialBuckets(1, 2, 10),
+	}, []string{"city"})
+
+	pgSyncRows = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "tdash_pg_sync_rows",
+		Help:    "Rows synced to postgres in a sync.",
+		Buckets: prometheus.ExponentialBuckets(1, 2, 14),
+	})
+
+	pgSyncErrorsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "tdash_pg_sync_errors_total",
+		Help: "Syncs to postgres that failed.",
+	})
+
+	pgSyncLag = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "tdash_pg_sync_lag_seconds",
+		Help: "Time between the latest screenshot in sqlite and the latest screenshot in postgres.",
+	})
+
+	stageRestartsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "tdash_stage_restarts_total",
+		Help: "Restarts of the stages of the pipeline by the supervisor.",
+	}, []string{"stage"})
+
+	diskFreeBytes = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "tdash_disk_free_bytes",
+		Help: "Disk space available for the combined screenshots.",
+	})
+
+	cityCongestion = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "tdash_city_congestion",
+		Help: "Congestion of the traffic summed over the cells of the latest round of the city, in [0, 1].",
+	}, []string{"city"})
+
+	cityTrafficPixels = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "tdash_city_traffic_pixels",
+		Help: "Pixels of each traffic class summed over the cells of the latest round of the city.",
+	}, []string{"city", "class"})
+)
+
+// observeCaptureRound records the outcome of the cells and of the capture round.
+func observeCaptureRound(manifest *captureManifest, duration time.Duration) {
+	for _, cell := range manifest.Cells {
+		tilesTotal.WithLabelValues(manifest.City, cell.Status).Inc()
+	}
+	captureRoundsTotal.WithLabelValues(manifest.City, manifest.Status).Inc()
+	captureDuration.WithLabelValues(manifest.City).Observe(duration.Seconds())
+}
+
+// observeCityTraffic records the traffic of the city summed over the cells of a round.
+func observeCityTraffic(city string, counts []trafficCounts) {
+	var total trafficCounts
+	for _, c := range counts {
+		total.Green += c.Green
+		total.Yellow += c.Yellow
+		total.Red += c.Red
+		total.DarkRed += c.DarkRed
+	}
+
+	cityCongestion.WithLabelValues(city).Set(total.congestion())
+	cityTrafficPixels.WithLabelValues(city, classGreen).Set(float64(total.Green))
+	cityTrafficPixels.WithLabelValues(city, classYellow).Set(float64(total.Yellow))
+	cityTrafficPixels.WithLabelValues(city, classRed).Set(float64(total.Red))
+	cityTrafficPixels.WithLabelValues(city, classDarkRed).Set(float64(total.DarkRed))
+}
+
+// serveMetrics runs the metrics server, which also has the health checks, on addr until
+// the context is cancelled. It runs with the periodic pipeline whether the dashboard is
+// served or not.
+func serveMetrics(ctx context.Context, addr string, db *sql.DB, health healthConfig) error {
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", promhttp.Handler())
+	newDashboardServer(db, nil, health).registerHealth(mux)
+	return serveHTTP(ctx, stageMetrics, addr, mux)
+}
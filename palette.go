@@ -0,0 +1,260 @@
+package main
+
+import (
+	"fmt"
+	"image/color"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	classGreen   = "green"
+	classYellow  = "yellow"
+	classRed     = "red"
+	classDarkRed = "dark_red"
+
+	metricAbs       = "abs"
+	metricEuclidean = "euclidean"
+	metricDeltaE    = "deltae"
+)
+
+var (
+	// mask value of each class, the classes are matched in this order
+	classMaskValues = []struct {
+		name  string
+		value uint8
+	}{
+		{classDarkRed, darkRedValueInMask},
+		{classRed, redValueInMask},
+		{classYellow, yellowValueInMask},
+		{classGreen, greenValueInMask},
+	}
+
+	// linear value of every sRGB channel value, so that computing the lookup
+	// table under the deltae metric does not call math.Pow for every color
+	srgbToLinear = func() (linear [256]float64) {
+		for c := range linear {
+			v := float64(c) / 255
+			if v <= 0.04045 {
+				linear[c] = v / 12.92
+			} else {
+				linear[c] = math.Pow((v+0.055)/1.055, 2.4)
+			}
+		}
+		return linear
+	}()
+)
+
+// paletteConfig defines the colors of the traffic classes in the screenshots.
+// A pixel belongs to a class if its distance from the color of the class, as per
+// the metric, is at most the tolerance of the class. Supported metrics are:
+//   - abs: absolute difference of each of the R, G and B channels
+//   - euclidean: euclidean distance in the RGB space
+//   - deltae: CIE76 delta E in the CIELAB space
+type paletteConfig struct {
+	Metric  string             `json:"metric"`
+	Classes []colorClassConfig `json:"classes"`
+}
+
+type colorClassConfig struct {
+	Name      string  `json:"name"`
+	Color     string  `json:"color"`
+	Tolerance float64 `json:"tolerance"`
+}
+
+type palette struct {
+	metric  string
+	classes []colorClass
+
+	// mask value of every 24 bit color, see lookupTable
+	lut     []uint8
+	lutOnce sync.Once
+}
+
+type colorClass struct {
+	name      string
+	color     color.RGBA
+	lab       [3]float64
+	tolerance float64
+	maskValue uint8
+}
+
+func defaultPaletteConfig() paletteConfig {
+	return paletteConfig{
+		Metric: metricAbs,
+		Classes: []colorClassConfig{
+			{Name: classDarkRed, Color: colorToHex(baseDarkRed), Tolerance: float64(threshold)},
+			{Name: classRed, Color: colorToHex(baseRed), Tolerance: float64(threshold)},
+			{Name: classYellow, Color: colorToHex(baseYellow), Tolerance: float64(threshold)},
+			{Name: classGreen, Color: colorToHex(baseGreen), Tolerance: float64(threshold)},
+		},
+	}
+}
+
+// readPalette reads the palette from the config, falling back to the default palette.
+func readPalette(conf *config) (*palette, error) {
+	if len(conf.Palette.Classes) == 0 {
+		conf.Palette = defaultPaletteConfig()
+	}
+	if conf.Palette.Metric == "" {
+		conf.Palette.Metric = metricAbs
+	}
+
+	p, err := newPalette(conf.Palette)
+	if err != nil {
+		return nil, fmt.Errorf("invalid palette: %w", err)
+	}
+	return p, nil
+}
+
+func newPalette(conf paletteConfig) (*palette, error) {
+	p := &palette{metric: conf.Metric}
+	switch p.metric {
+	case metricAbs, metricEuclidean, metricDeltaE:
+	default:
+		return nil, fmt.Errorf("unknown color distance metric [%v]", conf.Metric)
+	}
+
+	classes := make(map[string]colorClassConfig, len(conf.Classes))
+	for _, class := range conf.Classes {
+		if _, ok := classes[class.Name]; ok {
+			return nil, fmt.Errorf("duplicate color class [%v]", class.Name)
+		}
+		if class.Tolerance < 0 {
+			return nil, fmt.Errorf("color class [%v]: tolerance must not be negative", class.Name)
+		}
+		classes[class.Name] = class
+	}
+
+	for _, cm := range classMaskValues {
+		class, ok := classes[cm.name]
+		if !ok {
+			continue
+		}
+		delete(classes, cm.name)
+
+		c, err := parseHexColor(class.Color)
+		if err != nil {
+			return nil, fmt.Errorf("color class [%v]: %w", class.Name, err)
+		}
+		p.classes = append(p.classes, colorClass{
+			name:      class.Name,
+			color:     c,
+			lab:       rgbToLab(c.R, c.G, c.B),
+			tolerance: class.Tolerance,
+			maskValue: cm.value,
+		})
+	}
+
+	for name := range classes {
+		return nil, fmt.Errorf("unknown color class [%v]", name)
+	}
+	return p, nil
+}
+
+// lookupTable returns the mask value of every color indexed by lutIndex.
+// It is computed once for the palette on the first call, which takes a while,
+// so that the runs which do not analyze any screenshot never compute it.
+func (p *palette) lookupTable() []uint8 {
+	p.lutOnce.Do(func() {
+		p.lut = make([]uint8, 1<<24)
+
+		var wg sync.WaitGroup
+		for r := range 256 {
+			wg.Go(func() {
+				for g := range 256 {
+					for b := range 256 {
+						p.lut[lutIndex(uint8(r), uint8(g), uint8(b))] = p.classify(uint8(r), uint8(g), uint8(b))
+					}
+				}
+			})
+		}
+		wg.Wait()
+	})
+	return p.lut
+}
+
+func lutIndex(r, g, b uint8) int {
+	return int(r)<<16 | int(g)<<8 | int(b)
+}
+
+// classify returns the mask value of the class of the color, 0 if it belongs to none.
+func (p *palette) classify(r, g, b uint8) uint8 {
+	var lab [3]float64
+	if p.metric == metricDeltaE {
+		lab = rgbToLab(r, g, b)
+	}
+
+	for _, class := range p.classes {
+		if p.distance(r, g, b, lab, class) <= class.tolerance {
+			return class.maskValue
+		}
+	}
+	return 0
+}
+
+// distance between the color and the class as per the metric of the palette,
+// lab is the color in the CIELAB space and is only used by the deltae metric.
+func (p *palette) distance(r, g, b uint8, lab [3]float64, class colorClass) float64 {
+	switch p.metric {
+	case metricEuclidean:
+		dr := float64(r) - float64(class.color.R)
+		dg := float64(g) - float64(class.color.G)
+		db := float64(b) - float64(class.color.B)
+		return math.Sqrt(dr*dr + dg*dg + db*db)
+
+	case metricDeltaE:
+		dl := lab[0] - class.lab[0]
+		da := lab[1] - class.lab[1]
+		db := lab[2] - class.lab[2]
+		return math.Sqrt(dl*dl + da*da + db*db)
+
+	default:
+		return float64(max(absdiff(r, class.color.R), absdiff(g, class.color.G), absdiff(b, class.color.B)))
+	}
+}
+
+func absdiff(a, b uint8) uint8 {
+	if a > b {
+		return a - b
+	}
+	return b - a
+}
+
+// rgbToLab converts an sRGB color to CIELAB with the D65 white point.
+func rgbToLab(r, g, b uint8) [3]float64 {
+	rl, gl, bl := srgbToLinear[r], srgbToLinear[g], srgbToLinear[b]
+
+	x := (0.4124564*rl + 0.3575761*gl + 0.1804375*bl) / 0.95047
+	y := 0.2126729*rl + 0.7151522*gl + 0.0721750*bl
+	z := (0.0193339*rl + 0.1191920*gl + 0.9503041*bl) / 1.08883
+
+	f := func(t float64) float64 {
+		if t > 216.0/24389 {
+			return math.Cbrt(t)
+		}
+		return (24389.0/27*t + 16) / 116
+	}
+	fx, fy, fz := f(x), f(y), f(z)
+
+	return [3]float64{116*fy - 16, 500 * (fx - fy), 200 * (fy - fz)}
+}
+
+func parseHexColor(s string) (color.RGBA, error) {
+	hex := strings.TrimPrefix(s, "#")
+	if len(hex) != 6 {
+		return color.RGBA{}, fmt.Errorf("invalid color [%v], expected #RRGGBB", s)
+	}
+
+	v, err := strconv.ParseUint(hex, 16, 32)
+	if err != nil {
+		return color.RGBA{}, fmt.Errorf("invalid color [%v], expected #RRGGBB: %w", s, err)
+	}
+	return color.RGBA{uint8(v >> 16), uint8(v >> 8), uint8(v), 255}, nil
+}
+
+func colorToHex(c color.RGBA) string {
+	return fmt.Sprintf("#%02X%02X%02X", c.R, c.G, c.B)
+}
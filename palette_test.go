@@ -0,0 +1,220 @@
+package main
+
+import (
+	"encoding/json"
+	"image/color"
+	"math"
+	"testing"
+)
+
+func TestNewPalette(t *testing.T) {
+	var conf paletteConfig
+	if err := json.Unmarshal([]byte(`{
+		"metric": "euclidean",
+		"classes": [
+			{"name": "green", "color": "#16E098", "tolerance": 20},
+			{"name": "dark_red", "color": "a92727", "tolerance": 15.5}
+		]
+	}`), &conf); err != nil {
+		t.Fatal(err)
+	}
+	p, err := newPalette(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the classes are matched in the order of their mask values, not of the config
+	want := []colorClass{
+		{name: classDarkRed, color: color.RGBA{169, 39, 39, 255}, tolerance: 15.5, maskValue: darkRedValueInMask},
+		{name: classGreen, color: color.RGBA{22, 224, 152, 255}, tolerance: 20, maskValue: greenValueInMask},
+	}
+	if p.metric != metricEuclidean || len(p.classes) != len(want) {
+		t.Fatalf("palette has metric [%v] and [%v] classes, want [%v] and [%v]", p.metric, len(p.classes),
+			metricEuclidean, len(want))
+	}
+	for i, class := range p.classes {
+		if class.name != want[i].name || class.color != want[i].color || class.tolerance != want[i].tolerance ||
+			class.maskValue != want[i].maskValue {
+			t.Errorf("class %v = %+v, want %+v", i, class, want[i])
+		}
+	}
+}
+
+func TestNewPaletteErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		conf paletteConfig
+	}{
+		{"unknown metric", paletteConfig{Metric: "cie2000"}},
+		{"duplicate class", paletteConfig{Metric: metricAbs, Classes: []colorClassConfig{
+			{Name: classRed, Color: "#F24E42"}, {Name: classRed, Color: "#F24E43"},
+		}}},
+		{"negative tolerance", paletteConfig{Metric: metricAbs, Classes: []colorClassConfig{
+			{Name: classRed, Color: "#F24E42", Tolerance: -1},
+		}}},
+		{"unknown class", paletteConfig{Metric: metricAbs, Classes: []colorClassConfig{
+			{Name: "orange", Color: "#FFA500"},
+		}}},
+		{"invalid color", paletteConfig{Metric: metricAbs, Classes: []colorClassConfig{
+			{Name: classRed, Color: "red"},
+		}}},
+	}
+
+	for _, tt := range tests {
+		if _, err := newPalette(tt.conf); err == nil {
+			t.Errorf("%v: newPalette() succeeded, want error", tt.name)
+		}
+	}
+}
+
+func TestReadPalette(t *testing.T) {
+	conf := defaultConfig()
+	conf.Palette = paletteConfig{}
+	p, err := readPalette(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.metric != metricAbs || len(p.classes) != len(classMaskValues) {
+		t.Errorf("palette has metric [%v] and [%v] classes, want the default palette", p.metric, len(p.classes))
+	}
+	// the lookup table is only computed when a screenshot is analyzed
+	if p.lut != nil {
+		t.Error("lookup table is computed in reading the palette")
+	}
+}
+
+func TestParseHexColor(t *testing.T) {
+	tests := []struct {
+		s       string
+		want    color.RGBA
+		wantErr bool
+	}{
+		{s: "#A92727", want: color.RGBA{169, 39, 39, 255}},
+		{s: "#ffcf43", want: color.RGBA{255, 207, 67, 255}},
+		{s: "16E098", want: color.RGBA{22, 224, 152, 255}},
+		{s: "#000000", want: color.RGBA{0, 0, 0, 255}},
+		{s: "#FFF", wantErr: true},
+		{s: "#FFCF4300", wantErr: true},
+		{s: "#GGCF43", wantErr: true},
+		{s: "", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := parseHexColor(tt.s)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseHexColor(%q) error = %v, want error %v", tt.s, err, tt.wantErr)
+			continue
+		}
+		if tt.wantErr {
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseHexColor(%q) = %v, want %v", tt.s, got, tt.want)
+		}
+		if hex, err := parseHexColor(colorToHex(got)); err != nil || hex != got {
+			t.Errorf("color %v does not round trip through %v", got, colorToHex(got))
+		}
+	}
+}
+
+func TestPaletteDistance(t *testing.T) {
+	class := colorClass{color: color.RGBA{100, 100, 100, 255}, lab: rgbToLab(100, 100, 100)}
+
+	tests := []struct {
+		metric  string
+		r, g, b uint8
+		want    float64
+	}{
+		{metricAbs, 100, 100, 100, 0},
+		{metricAbs, 103, 96, 100, 4},
+		{metricAbs, 90, 110, 105, 10},
+		{metricEuclidean, 100, 100, 100, 0},
+		{metricEuclidean, 103, 96, 100, 5},
+		{metricEuclidean, 90, 110, 105, 15},
+		{metricDeltaE, 100, 100, 100, 0},
+	}
+
+	for _, tt := range tests {
+		p := &palette{metric: tt.metric}
+		if got := p.distance(tt.r, tt.g, tt.b, rgbToLab(tt.r, tt.g, tt.b), class); math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("%v distance of [%v %v %v] = %v, want %v", tt.metric, tt.r, tt.g, tt.b, got, tt.want)
+		}
+	}
+
+	// delta E between black and white is the difference of their lightness
+	p := &palette{metric: metricDeltaE}
+	white := colorClass{color: color.RGBA{255, 255, 255, 255}, lab: rgbToLab(255, 255, 255)}
+	if d := p.distance(0, 0, 0, rgbToLab(0, 0, 0), white); math.Abs(d-100) > 0.01 {
+		t.Errorf("delta E between black and white = %v, want 100", d)
+	}
+}
+
+func TestRGBToLab(t *testing.T) {
+	tests := []struct {
+		r, g, b uint8
+		want    [3]float64
+	}{
+		{0, 0, 0, [3]float64{0, 0, 0}},
+		{255, 255, 255, [3]float64{100, 0, 0}},
+		{255, 0, 0, [3]float64{53.24, 80.09, 67.20}},
+		{0, 255, 0, [3]float64{87.73, -86.18, 83.18}},
+		{0, 0, 255, [3]float64{32.30, 79.19, -107.86}},
+	}
+
+	for _, tt := range tests {
+		got := rgbToLab(tt.r, tt.g, tt.b)
+		for i := range got {
+			if math.Abs(got[i]-tt.want[i]) > 0.01 {
+				t.Errorf("lab of [%v %v %v] = %v, want %v", tt.r, tt.g, tt.b, got, tt.want)
+				break
+			}
+		}
+	}
+}
+
+func TestPaletteClassify(t *testing.T) {
+	tests := []struct {
+		metric  string
+		r, g, b uint8
+		want    uint8
+	}{
+		// the tolerance of the default palette is 10
+		{metricAbs, 169, 39, 39, darkRedValueInMask},
+		{metricAbs, 179, 29, 49, darkRedValueInMask},
+		{metricAbs, 180, 39, 39, 0},
+		{metricEuclidean, 175, 47, 39, darkRedValueInMask},
+		{metricEuclidean, 176, 47, 39, 0},
+		{metricAbs, 255, 207, 67, yellowValueInMask},
+		{metricAbs, 22, 224, 152, greenValueInMask},
+		{metricDeltaE, 242, 78, 66, redValueInMask},
+		{metricDeltaE, 255, 255, 255, 0},
+	}
+
+	for _, tt := range tests {
+		conf := defaultPaletteConfig()
+		conf.Metric = tt.metric
+		p, err := newPalette(conf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := p.classify(tt.r, tt.g, tt.b); got != tt.want {
+			t.Errorf("%v class of [%v %v %v] = %v, want %v", tt.metric, tt.r, tt.g, tt.b, got, tt.want)
+		}
+	}
+}
+
+func BenchmarkPaletteLookupTable(b *testing.B) {
+	for _, metric := range []string{metricAbs, metricEuclidean, metricDeltaE} {
+		b.Run(metric, func(b *testing.B) {
+			conf := defaultPaletteConfig()
+			conf.Metric = metric
+			for b.Loop() {
+				p, err := newPalette(conf)
+				if err != nil {
+					b.Fatal(err)
+				}
+				p.lookupTable()
+			}
+		})
+	}
+}
@@ -6,7 +6,6 @@ import (
 	"fmt"
 	"log"
 	"os"
-	"sync"
 	"time"
 
 	"github.com/jackc/pgx/v5"
@@ -16,75 +15,222 @@ import (
 const (
 	requestTimeout = time.Minute
 
+	defaultSyncBatchSize = 1000
+
 	createTablePGDDL = `CREATE TABLE IF NOT EXISTS traffic(ss_path TEXT PRIMARY KEY,
-		yellow INTEGER, red INTEGER, dark_red INTEGER, ts TIMESTAMP, x INTEGER, y INTEGER);`
+		yellow INTEGER, red INTEGER, dark_red INTEGER, ts TIMESTAMP, x INTEGER, y INTEGER, city TEXT,
+		green INTEGER, congestion REAL, road_pixels INTEGER, yellow_pct REAL, red_pct REAL, dark_red_pct REAL);`
+	createSegmentTablePGDDL = `CREATE TABLE IF NOT EXISTS segment_traffic(ss_path TEXT, segment_id INTEGER,
+		city TEXT, ts TIMESTAMP, x INTEGER, y INTEGER, green INTEGER, yellow INTEGER, red INTEGER, dark_red INTEGER,
+		road_pixels INTEGER, congestion REAL, PRIMARY KEY (ss_path, segment_id));`
 	latestSsPathPGSQL  = `SELECT ss_path FROM traffic ORDER BY ss_path COLLATE "C" DESC LIMIT 1`
-	insertTrafficPGSQL = `INSERT INTO traffic(ss_path, yellow, red, dark_red, ts, x, y) VALUES($1, $2, $3, $4, $5, $6, $7)`
+	updateTrafficPGSQL = `UPDATE traffic SET green = $2, yellow = $3, red = $4, dark_red = $5, congestion = $6,
+		road_pixels = $7, yellow_pct = $8, red_pct = $9, dark_red_pct = $10 WHERE ss_path = $1`
+
+	// the staging table lives until the end of the transaction of the sync
+	trafficStagingTablePG     = "traffic_staging"
+	createTrafficStagingPGDDL = `CREATE TEMP TABLE traffic_staging (LIKE traffic INCLUDING DEFAULTS) ON COMMIT DROP`
+	upsertTrafficPGSQL        = `INSERT INTO traffic(ss_path, yellow, red, dark_red, ts, x, y, city, green, congestion,
+		road_pixels, yellow_pct, red_pct, dark_red_pct) SELECT ss_path, yellow, red, dark_red, ts, x, y, city, green,
+		congestion, road_pixels, yellow_pct, red_pct, dark_red_pct FROM traffic_staging
+		ON CONFLICT (ss_path) DO UPDATE SET yellow = EXCLUDED.yellow, red = EXCLUDED.red, dark_red = EXCLUDED.dark_red,
+		ts = EXCLUDED.ts, x = EXCLUDED.x, y = EXCLUDED.y, city = EXCLUDED.city, green = EXCLUDED.green,
+		congestion = EXCLUDED.congestion, road_pixels = EXCLUDED.road_pixels, yellow_pct = EXCLUDED.yellow_pct,
+		red_pct = EXCLUDED.red_pct, dark_red_pct = EXCLUDED.dark_red_pct`
+	deleteSegmentTrafficPGSQL = `DELETE FROM segment_traffic WHERE ss_path = ANY($1)`
 )
 
 var (
+	trafficColumnsPG = []string{"ss_path", "yellow", "red", "dark_red", "ts", "x", "y", "city", "green",
+		"congestion", "road_pixels", "yellow_pct", "red_pct", "dark_red_pct"}
+	segmentTrafficColumnsPG = []string{"ss_path", "segment_id", "city", "ts", "x", "y", "green", "yellow", "red",
+		"dark_red", "road_pixels", "congestion"}
+
+	migrationsPGDDL = []string{
+		`ALTER TABLE traffic ADD COLUMN IF NOT EXISTS city TEXT;`,
+		`UPDATE traffic SET city = 'jaipur' WHERE city IS NULL;`,
+		`ALTER TABLE traffic ADD COLUMN IF NOT EXISTS green INTEGER;`,
+		`ALTER TABLE traffic ADD COLUMN IF NOT EXISTS congestion REAL;`,
+		`ALTER TABLE traffic ADD COLUMN IF NOT EXISTS road_pixels INTEGER;`,
+		`ALTER TABLE traffic ADD COLUMN IF NOT EXISTS yellow_pct REAL;`,
+		`ALTER TABLE traffic ADD COLUMN IF NOT EXISTS red_pct REAL;`,
+		`ALTER TABLE traffic ADD COLUMN IF NOT EXISTS dark_red_pct REAL;`,
+	}
+
 	createIndexesPGDDL = []string{
 		`CREATE INDEX IF NOT EXISTS idx_traffic_xy_ts ON traffic (x, y, ts);`,
 		`CREATE INDEX IF NOT EXISTS idx_traffic_ts ON traffic (ts);`,
+		`CREATE INDEX IF NOT EXISTS idx_traffic_city_xy_ts ON traffic (city, x, y, ts);`,
+		`CREATE INDEX IF NOT EXISTS idx_segment_traffic_city_xy_ts ON segment_traffic (city, x, y, segment_id, ts);`,
 	}
 )
 
-func periodicSyncToPG(db *sql.DB, hint chan struct{}, quit <-chan os.Signal, wg *sync.WaitGroup) {
-	defer wg.Done()
+// syncConfig configures the sync of the traffic in sqlite to postgres.
+type syncConfig struct {
+	// rows synced in a transaction, the next batch is synced right after a full one
+	BatchSize int `json:"batch_size"`
+}
 
-	pgpool, err := pgxpool.New(context.Background(), os.Getenv("POSTGRES_URL"))
-	if err != nil {
-		panic(err)
+func defaultSyncConfig() syncConfig {
+	return syncConfig{BatchSize: defaultSyncBatchSize}
+}
+
+func (c syncConfig) validate() error {
+	if c.BatchSize <= 0 {
+		return fmt.Errorf("sync batch size must be positive")
 	}
+	return nil
+}
 
-	if _, err := pgpool.Exec(context.Background(), createTablePGDDL); err != nil {
-		panic(err)
+func periodicSyncToPG(ctx context.Context, db *sql.DB, conf syncConfig, hint chan struct{}) error {
+	pgpool, err := openPG(ctx)
+	if err != nil {
+		syncLag.observe(ctx, nil, db)
+		return err
 	}
+	defer pgpool.Close()
 
-	for _, ddl := range createIndexesPGDDL {
-		if _, err := pgpool.Exec(context.Background(), ddl); err != nil {
-			panic(err)
-		}
+	if err := markLegacyTrafficUnsynced(ctx, pgpool, db); err != nil {
+		return err
 	}
 
 	for {
 		select {
-		case <-quit:
+		case <-ctx.Done():
 			log.Println("shutting down PG sync!")
-			return
+			return nil
 
 		case <-hint:
-			if err := syncLatestSqliteToPG(pgpool, db, hint, quit); err != nil {
+			err := syncLatestSqliteToPG(ctx, pgpool, db, conf, hint)
+			switch {
+			case ctx.Err() != nil:
+				log.Println("shutting down PG sync!")
+				return nil
+			case err != nil:
 				log.Printf("error while syncing sqlite DB to postgres; %v", err)
+				pgSyncErrorsTotal.Inc()
+				pipeline.failure(stageSync, err)
+			default:
+				pipeline.success(stageSync)
 			}
+			syncLag.observe(ctx, pgpool, db)
 		}
 	}
 }
 
-func syncLatestSqliteToPG(pgpool *pgxpool.Pool, db *sql.DB,
-	hint chan struct{}, quit <-chan os.Signal) error {
+// syncOnceToPG syncs all the unsynced traffic in sqlite to postgres, a batch at a time.
+func syncOnceToPG(ctx context.Context, db *sql.DB, conf syncConfig) error {
+	pgpool, err := openPG(ctx)
+	if err != nil {
+		return err
+	}
+	defer pgpool.Close()
 
-	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
-	defer cancel()
+	if err := markLegacyTrafficUnsynced(ctx, pgpool, db); err != nil {
+		return err
+	}
+
+	// a full batch hints that there is a next one
+	hint := make(chan struct{}, 1)
+	for {
+		if err := syncLatestSqliteToPG(ctx, pgpool, db, conf, hint); err != nil {
+			return fmt.Errorf("error while syncing sqlite DB to postgres: %w", err)
+		}
+		select {
+		case <-hint:
+		default:
+			return nil
+		}
+	}
+}
+
+// openPG connects to the postgres at POSTGRES_URL and creates the schema if needed.
+func openPG(ctx context.Context) (*pgxpool.Pool, error) {
+	pgpool, err := pgxpool.New(ctx, os.Getenv("POSTGRES_URL"))
+	if err != nil {
+		return nil, fmt.Errorf("error in connecting to postgres: %w", err)
+	}
+
+	if _, err := pgpool.Exec(ctx, createTablePGDDL); err != nil {
+		pgpool.Close()
+		return nil, fmt.Errorf("error in creating table [traffic] in postgres: %w", err)
+	}
 
-	var latestSsPathNull sql.NullString
-	if err := pgpool.QueryRow(ctx, latestSsPathPGSQL).Scan(&latestSsPathNull); err != nil && err != pgx.ErrNoRows {
+	if _, err := pgpool.Exec(ctx, createSegmentTablePGDDL); err != nil {
+		pgpool.Close()
+		return nil, fmt.Errorf("error in creating table [segment_traffic] in postgres: %w", err)
+	}
+
+	for _, ddl := range migrationsPGDDL {
+		if _, err := pgpool.Exec(ctx, ddl); err != nil {
+			pgpool.Close()
+			return nil, fmt.Errorf("error in migrating postgres: %w", err)
+		}
+	}
+
+	for _, ddl := range createIndexesPGDDL {
+		if _, err := pgpool.Exec(ctx, ddl); err != nil {
+			pgpool.Close()
+			return nil, fmt.Errorf("error in creating indexes in postgres: %w", err)
+		}
+	}
+
+	return pgpool, nil
+}
+
+// markLegacyTrafficUnsynced marks the rows written before the rows had versions, which are
+// after the latest screenshot in postgres, to be synced. Those were synced in the order of
+// the screenshots.
+func markLegacyTrafficUnsynced(ctx context.Context, pgpool *pgxpool.Pool, db *sql.DB) error {
+	var latestSsPath sql.NullString
+	if err := pgpool.QueryRow(ctx, latestSsPathPGSQL).Scan(&latestSsPath); err != nil && err != pgx.ErrNoRows {
 		return fmt.Errorf("error in getting latest timestamp: %w", err)
 	}
-	var latestSsPath string
-	if latestSsPathNull.Valid {
-		latestSsPath = latestSsPathNull.String
+	if err := markTrafficUnsynced(ctx, db, latestSsPath.String); err != nil {
+		return fmt.Errorf("error in marking traffic unsynced: %w", err)
 	}
+	return nil
+}
 
-	rows, err := getRecentTraffic(db, latestSsPath)
+// syncLatestSqliteToPG copies a batch of the unsynced rows to a staging table in postgres
+// and upserts them from there into the traffic, which makes the sync idempotent. The rows
+// are marked synced in sqlite only after the batch is committed, a failed sync is retried
+// with the same rows.
+func syncLatestSqliteToPG(ctx context.Context, pgpool *pgxpool.Pool, db *sql.DB, conf syncConfig,
+	hint chan struct{}) error {
+
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+
+	batch, versions, err := readUnsyncedTraffic(ctx, db, conf.BatchSize)
 	if err != nil {
-		return fmt.Errorf("error in getting recent traffic: %w", err)
+		return fmt.Errorf("error in getting unsynced traffic: %w", err)
 	}
-	defer func() {
-		if err := rows.Close(); err != nil {
-			log.Printf("error in closing rows: %v", err)
+
+	if len(batch) > 0 {
+		if err := upsertTrafficPG(ctx, pgpool, db, batch); err != nil {
+			return err
 		}
-	}()
+		if err := markTrafficSynced(ctx, db, versions); err != nil {
+			return fmt.Errorf("error in marking traffic synced: %w", err)
+		}
+	}
+
+	if len(batch) == conf.BatchSize {
+		notifySync(hint)
+	}
+
+	log.Printf("synced [%v] rows to postgres", len(batch))
+	pgSyncRows.Observe(float64(len(batch)))
+	return nil
+}
+
+// upsertTrafficPG writes the rows and their segment traffic to postgres in a transaction.
+func upsertTrafficPG(ctx context.Context, pgpool *pgxpool.Pool, db *sql.DB, batch [][]any) (err error) {
+	ssPaths := make([]string, 0, len(batch))
+	for _, row := range batch {
+		ssPaths = append(ssPaths, row[0].(string))
+	}
 
 	tx, err := pgpool.Begin(ctx)
 	if err != nil {
@@ -96,41 +242,188 @@ func syncLatestSqliteToPG(pgpool *pgxpool.Pool, db *sql.DB,
 		}
 	}()
 
-	rowsCount := 0
-loop:
-	for rows.Next() {
-		select {
-		case <-quit:
-			break loop
-		default:
-		}
+	if _, err = tx.Exec(ctx, createTrafficStagingPGDDL); err != nil {
+		return fmt.Errorf("error in creating staging table in postgres: %w", err)
+	}
+	if _, err = tx.CopyFrom(ctx, pgx.Identifier{trafficStagingTablePG}, trafficColumnsPG,
+		pgx.CopyFromRows(batch)); err != nil {
+		return fmt.Errorf("error in copying into postgres: %w", err)
+	}
+	if _, err = tx.Exec(ctx, upsertTrafficPGSQL); err != nil {
+		return fmt.Errorf("error in upserting into postgres: %w", err)
+	}
+	if err = syncSegmentTrafficToPG(ctx, tx, db, ssPaths); err != nil {
+		return err
+	}
 
-		if err := rows.Err(); err != nil {
-			return fmt.Errorf("sqlite rows iteration error: %w", err)
+	if err = tx.Commit(ctx); err != nil {
+		return fmt.Errorf("error committing pg transaction: %w", err)
+	}
+	return nil
+}
+
+// readUnsyncedTraffic returns up to limit unsynced rows in the order of the traffic
+// columns in postgres, and the version of each row by its screenshot.
+func readUnsyncedTraffic(ctx context.Context, db *sql.DB, limit int) ([][]any, map[string]int64, error) {
+	rows, err := getUnsyncedTraffic(ctx, db, limit)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			log.Printf("error in closing rows: %v", err)
 		}
+	}()
 
+	var batch [][]any
+	versions := make(map[string]int64)
+	for rows.Next() {
 		var ssPath string
 		var x, y, yellow, red, darkRed int
-		var ts string
-		if err = rows.Scan(&ssPath, &yellow, &red, &darkRed, &ts, &x, &y); err != nil {
-			return fmt.Errorf("error scanning sqlite row: %w", err)
+		var ts, city string
+		var version int64
+		// rows analyzed before these were computed have them as NULL
+		var green, roadPixels sql.NullInt64
+		var congestion, yellowPct, redPct, darkRedPct sql.NullFloat64
+		if err := rows.Scan(&ssPath, &yellow, &red, &darkRed, &ts, &x, &y, &city, &green, &congestion,
+			&roadPixels, &yellowPct, &redPct, &darkRedPct, &version); err != nil {
+			return nil, nil, fmt.Errorf("error scanning sqlite row: %w", err)
 		}
 
-		if _, err := tx.Exec(ctx, insertTrafficPGSQL, ssPath, yellow, red, darkRed, ts, x, y); err != nil {
-			return fmt.Errorf("error inserting into postgres: %w", err)
+		tsPG, err := parsePGTimestamp(ts)
+		if err != nil {
+			return nil, nil, err
 		}
+		batch = append(batch, []any{ssPath, yellow, red, darkRed, tsPG, x, y, city,
+			green, congestion, roadPixels, yellowPct, redPct, darkRedPct})
+		versions[ssPath] = version
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, fmt.Errorf("sqlite rows iteration error: %w", err)
+	}
+	return batch, versions, nil
+}
 
-		rowsCount++
+// parsePGTimestamp parses the local time of a row in sqlite for the TIMESTAMP columns of postgres,
+// which have no time zone. The COPY does not parse text for them as the values are sent in binary.
+func parsePGTimestamp(ts string) (time.Time, error) {
+	t, err := time.ParseInLocation(time.DateTime, ts, time.UTC)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("error in parsing timestamp [%v]: %w", ts, err)
 	}
+	return t, nil
+}
 
-	if err := tx.Commit(ctx); err != nil {
-		return fmt.Errorf("error committing pg transaction: %w", err)
+// syncLagObserver records the time between the latest screenshot in sqlite and the
+// latest screenshot in postgres after every sync, failed or not. The latest screenshot
+// in postgres is kept from the last time postgres was reachable so that the lag grows
+// while it is down, until then the latest screenshot marked synced in sqlite is used.
+type syncLagObserver struct {
+	pgSsPath  string
+	pgReached bool
+}
+
+var syncLag = &syncLagObserver{}
+
+// observe updates the sync lag, pgpool is nil when postgres could not be opened.
+func (o *syncLagObserver) observe(ctx context.Context, pgpool *pgxpool.Pool, db *sql.DB) {
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+
+	if pgpool != nil {
+		var latestSsPath sql.NullString
+		if err := pgpool.QueryRow(ctx, latestSsPathPGSQL).Scan(&latestSsPath); err == nil || err == pgx.ErrNoRows {
+			o.pgSsPath, o.pgReached = latestSsPath.String, true
+		} else {
+			log.Printf("error in getting latest ss path from postgres: %v", err)
+		}
+	}
+	if !o.pgReached {
+		synced, err := getLatestSyncedSsPath(ctx, db)
+		if err != nil {
+			log.Printf("error in getting latest synced ss path: %v", err)
+			return
+		}
+		o.pgSsPath = synced
 	}
 
-	if rowsCount == maxRecentRows {
-		hint <- struct{}{}
+	sqliteSsPath, err := getLatestSsPath(ctx, db)
+	if err != nil {
+		log.Printf("error in getting latest ss path: %v", err)
+		return
+	}
+	if sqliteSsPath == "" || o.pgSsPath == "" {
+		pgSyncLag.Set(0)
+		return
 	}
 
-	log.Printf("synced [%v] rows to postgres", rowsCount)
+	sqliteTs, err := ssPathTime(sqliteSsPath)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	pgTs, err := ssPathTime(o.pgSsPath)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	pgSyncLag.Set(max(sqliteTs.Sub(pgTs).Seconds(), 0))
+}
+
+// syncSegmentTrafficToPG replaces the segment traffic of the screenshots in postgres with the one in sqlite.
+func syncSegmentTrafficToPG(ctx context.Context, tx pgx.Tx, db *sql.DB, ssPaths []string) error {
+	if _, err := tx.Exec(ctx, deleteSegmentTrafficPGSQL, ssPaths); err != nil {
+		return fmt.Errorf("error deleting segment traffic from postgres: %w", err)
+	}
+
+	var segments [][]any
+	for _, ssPath := range ssPaths {
+		rows, err := readSegmentTraffic(ctx, db, ssPath)
+		if err != nil {
+			return err
+		}
+		segments = append(segments, rows...)
+	}
+
+	if _, err := tx.CopyFrom(ctx, pgx.Identifier{"segment_traffic"}, segmentTrafficColumnsPG,
+		pgx.CopyFromRows(segments)); err != nil {
+		return fmt.Errorf("error copying segment traffic into postgres: %w", err)
+	}
 	return nil
 }
+
+// readSegmentTraffic returns the segment traffic of the screenshot in the order of the
+// segment traffic columns in postgres.
+func readSegmentTraffic(ctx context.Context, db *sql.DB, ssPath string) ([][]any, error) {
+	rows, err := getSegmentTraffic(ctx, db, ssPath)
+	if err != nil {
+		return nil, fmt.Errorf("error in getting segment traffic [%v]: %w", ssPath, err)
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			log.Printf("error in closing rows: %v", err)
+		}
+	}()
+
+	var segments [][]any
+	for rows.Next() {
+		var segmentID, x, y, green, yellow, red, darkRed, roadPixels int
+		var ts, city string
+		var congestion float64
+		if err := rows.Scan(&segmentID, &city, &ts, &x, &y, &green, &yellow, &red, &darkRed,
+			&roadPixels, &congestion); err != nil {
+			return nil, fmt.Errorf("error scanning sqlite segment row: %w", err)
+		}
+
+		tsPG, err := parsePGTimestamp(ts)
+		if err != nil {
+			return nil, err
+		}
+		segments = append(segments, []any{ssPath, segmentID, city, tsPG, x, y,
+			green, yellow, red, darkRed, roadPixels, congestion})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("sqlite rows iteration error: %w", err)
+	}
+	return segments, nil
+}
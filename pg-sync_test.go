@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestSyncLagWhilePostgresIsDown(t *testing.T) {
+	db := newTestDB(t)
+	ctx := context.Background()
+
+	for _, ssPath := range []string{"20250102-150000-jaipur-x1-y1.png", "20250102-150405-jaipur-x1-y1.png"} {
+		if err := insertTraffic(ctx, db, "jaipur", ssPath, trafficCounts{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := db.Exec(`UPDATE traffic SET synced_version = version WHERE ss_path LIKE '20250102-150000-%'`); err != nil {
+		t.Fatal(err)
+	}
+
+	// postgres was never reached, the latest screenshot marked synced in sqlite stands in
+	o := &syncLagObserver{}
+	o.observe(ctx, nil, db)
+	if got := testutil.ToFloat64(pgSyncLag); got != 245 {
+		t.Errorf("sync lag = %v, want 245", got)
+	}
+
+	// the latest screenshot seen in postgres is kept while it is down
+	o = &syncLagObserver{pgSsPath: "20250102-140405-jaipur-x1-y1.png", pgReached: true}
+	o.observe(ctx, nil, db)
+	if got := testutil.ToFloat64(pgSyncLag); got != 3600 {
+		t.Errorf("sync lag = %v, want 3600", got)
+	}
+}
+
+// TestSyncLatestSqliteToPG syncs to the postgres at POSTGRES_URL and is skipped if it
+// is not set. The rows of the test are in their own city, which is cleared around it.
+func TestSyncLatestSqliteToPG(t *testing.T) {
+	if os.Getenv("POSTGRES_URL") == "" {
+		t.Skip("POSTGRES_URL is not set")
+	}
+
+	const city = "tdash_sync_test"
+	db := newTestDB(t)
+	ctx := context.Background()
+	pgpool, err := openPG(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clearPG := func() {
+		for _, table := range []string{"traffic", "segment_traffic"} {
+			if _, err := pgpool.Exec(ctx, fmt.Sprintf("DELETE FROM %v WHERE city = $1", table), city); err != nil {
+				t.Error(err)
+			}
+		}
+	}
+	clearPG()
+	t.Cleanup(func() {
+		clearPG()
+		pgpool.Close()
+	})
+
+	var ssPaths []string
+	for i := range 5 {
+		ssPath := fmt.Sprintf("20000102-1504%02d-%v-x%v-y1.png", i, city, i)
+		counts := trafficCounts{Green: 10, Yellow: i, Red: 1, DarkRed: 1, RoadPixels: 20}
+		if err := insertTraffic(ctx, db, city, ssPath, counts); err != nil {
+			t.Fatal(err)
+		}
+		segments := []segmentCounts{{ID: 1, trafficCounts: counts}, {ID: 2, trafficCounts: counts}}
+		if err := insertSegmentTraffic(ctx, db, city, ssPath, i, 1, segments); err != nil {
+			t.Fatal(err)
+		}
+		ssPaths = append(ssPaths, ssPath)
+	}
+
+	// the rows are synced in batches, the next one is hinted after a full batch
+	conf := syncConfig{BatchSize: 2}
+	hint := make(chan struct{}, 1)
+	for range 3 {
+		if err := syncLatestSqliteToPG(ctx, pgpool, db, conf, hint); err != nil {
+			t.Fatal(err)
+		}
+	}
+	assertSynced(t, ctx, pgpool, db, city)
+
+	// a rewritten row is synced again
+	if err := insertTraffic(ctx, db, city, ssPaths[0], trafficCounts{Yellow: 7}); err != nil {
+		t.Fatal(err)
+	}
+	if err := syncLatestSqliteToPG(ctx, pgpool, db, conf, hint); err != nil {
+		t.Fatal(err)
+	}
+	assertSynced(t, ctx, pgpool, db, city)
+	var yellow int
+	if err := pgpool.QueryRow(ctx, `SELECT yellow FROM traffic WHERE ss_path = $1`, ssPaths[0]).Scan(&yellow); err != nil {
+		t.Fatal(err)
+	}
+	if yellow != 7 {
+		t.Errorf("yellow of the rewritten row in postgres = %v, want 7", yellow)
+	}
+}
+
+// assertSynced checks that no row of sqlite is left to sync, and that the traffic and
+// segment traffic of the city have the same number of rows in sqlite and postgres.
+func assertSynced(t *testing.T, ctx context.Context, pgpool *pgxpool.Pool, db *sql.DB, city string) {
+	t.Helper()
+
+	batch, _, err := readUnsyncedTraffic(ctx, db, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(batch) != 0 {
+		t.Errorf("[%v] rows are not synced", len(batch))
+	}
+
+	for _, table := range []string{"traffic", "segment_traffic"} {
+		query := fmt.Sprintf("SELECT COUNT(*) FROM %v WHERE city = ", table)
+		var sqliteRows, pgRows int
+		if err := db.QueryRowContext(ctx, query+"?", city).Scan(&sqliteRows); err != nil {
+			t.Fatal(err)
+		}
+		if err := pgpool.QueryRow(ctx, query+"$1", city).Scan(&pgRows); err != nil {
+			t.Fatal(err)
+		}
+		if sqliteRows == 0 || pgRows != sqliteRows {
+			t.Errorf("[%v] has [%v] rows in postgres and [%v] in sqlite", table, pgRows, sqliteRows)
+		}
+	}
+}
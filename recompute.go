@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// recomputeTraffic re-counts the traffic of every cell from the combined masks and
+// overwrites the rows in SQLite and, if POSTGRES_URL is set, in postgres. Earlier,
+// the traffic was counted over the top left region of the mask instead of the
+// cropped region. Only the rows that already exist are updated, the cells that were
+// not captured in a round are black in the combined mask and are left alone.
+//
+// The coordinates label in the top left corner of each cell of a combined mask
+// hides the traffic beneath it, which is not counted. The segment traffic of the
+// cells with a segment map is replaced as well.
+func recomputeTraffic(ctx context.Context, cities []*cityConfig, city string, db *sql.DB) error {
+	log.Printf("---- recomputing traffic from masks in [%v] ----", maskCombFolder)
+	defer log.Println("---- traffic recomputed ----")
+
+	var pgpool *pgxpool.Pool
+	if os.Getenv("POSTGRES_URL") != "" {
+		var err error
+		pgpool, err = openPG(ctx)
+		if err != nil {
+			return err
+		}
+		defer pgpool.Close()
+	}
+
+	var files []string
+	if err := filepath.WalkDir(maskCombFolder, func(maskCombPath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return fmt.Errorf("error in walking dir [%v]: %w", maskCombFolder, err)
+		}
+		if d.IsDir() || !strings.HasSuffix(d.Name(), ".png") {
+			return nil
+		}
+		if city != "" && !strings.HasSuffix(d.Name(), "-"+city+".png") {
+			return nil
+		}
+
+		files = append(files, maskCombPath)
+		return nil
+	}); err != nil {
+		return fmt.Errorf("error in walking dir for recomputing traffic [%v]: %w", maskCombFolder, err)
+	}
+
+	log.Printf("found [%v] combined masks", len(files))
+	for _, file := range files {
+		select {
+		case <-ctx.Done():
+			log.Println("shutting down...")
+			return nil
+		default:
+		}
+
+		if err := recomputeCombinedMask(ctx, file, cities, db, pgpool); err != nil {
+			log.Printf("error in recomputing traffic [%v]: %v", file, err)
+		}
+	}
+
+	return nil
+}
+
+func recomputeCombinedMask(ctx context.Context, maskCombPath string, cities []*cityConfig, db *sql.DB,
+	pgpool *pgxpool.Pool) error {
+
+	img, err := readImage(maskCombPath)
+	if err != nil {
+		return err
+	}
+
+	// the gray value of the mask is preserved when converting back from RGBA
+	mask := image.NewGray(img.Bounds())
+	draw.Draw(mask, mask.Bounds(), img, img.Bounds().Min, draw.Src)
+
+	numCols := mask.Bounds().Dx() / imageWidthWithLeaveOuts
+	numRows := mask.Bounds().Dy() / imageHeightWithLeaveOuts
+	prefix := strings.TrimSuffix(filepath.Base(maskCombPath), ".png")
+	city := prefixCity(prefix, cities)
+	if manifest, err := readManifest(prefix); err == nil {
+		numCols, numRows = manifest.NumCols, manifest.NumRows
+		city = manifest.City
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	updated := 0
+	for x := range numCols {
+		for y := range numRows {
+			draw.Draw(mask, coordinatesRect(x, y), &image.Uniform{color.Gray{0}}, image.Point{}, draw.Src)
+
+			minX := x * imageWidthWithLeaveOuts
+			minY := y * imageHeightWithLeaveOuts
+			counts := countTraffic(mask, image.Rect(minX, minY, minX+imageWidthWithLeaveOuts, minY+imageHeightWithLeaveOuts))
+			counts.RoadPixels, err = roadPixels(city, x, y)
+			if err != nil {
+				return err
+			}
+			segmentMap, err := readSegmentMap(city, x, y)
+			if err != nil {
+				return err
+			}
+			var segments []segmentCounts
+			if segmentMap != nil {
+				segments = countSegmentTraffic(mask, image.Point{minX, minY}, segmentMap)
+			}
+
+			ssPath := fmt.Sprintf(fileNameFmt, ssFolder, prefix, x, y)
+			exists, err := updateTraffic(ctx, db, ssPath, counts)
+			if err != nil {
+				return fmt.Errorf("error in updating traffic [%v]: %w", ssPath, err)
+			}
+			if !exists {
+				continue
+			}
+			updated++
+
+			if err := insertSegmentTraffic(ctx, db, city, ssPath, x, y, segments); err != nil {
+				return fmt.Errorf("error in updating segment traffic [%v]: %w", ssPath, err)
+			}
+
+			if pgpool == nil {
+				continue
+			}
+			if err := updateTrafficPG(ctx, pgpool, db, ssPath, counts); err != nil {
+				return fmt.Errorf("error in updating traffic in postgres [%v]: %w", ssPath, err)
+			}
+		}
+	}
+
+	log.Printf("recomputed traffic of [%v] cells from [%v]", updated, maskCombPath)
+	return nil
+}
+
+// prefixCity returns the city at the end of the prefix if it is one of the cities. The
+// prefixes from before multi city support end with the time instead and are from Jaipur.
+func prefixCity(prefix string, cities []*cityConfig) string {
+	if i := strings.LastIndex(prefix, "-"); i >= 0 {
+		for _, city := range cities {
+			if city.Name == prefix[i+1:] {
+				return city.Name
+			}
+		}
+	}
+	return defaultCityName
+}
+
+func updateTrafficPG(ctx context.Context, pgpool *pgxpool.Pool, db *sql.DB, ssPath string,
+	counts trafficCounts) (err error) {
+
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+
+	tx, err := pgpool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("error starting pg transaction: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback(ctx)
+		}
+	}()
+
+	if _, err = tx.Exec(ctx, updateTrafficPGSQL, filepath.Base(ssPath),
+		counts.Green, counts.Yellow, counts.Red, counts.DarkRed, counts.congestion(), counts.RoadPixels,
+		counts.percent(counts.Yellow), counts.percent(counts.Red), counts.percent(counts.DarkRed)); err != nil {
+		return err
+	}
+	if err = syncSegmentTrafficToPG(ctx, tx, db, []string{filepath.Base(ssPath)}); err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
@@ -0,0 +1,23 @@
+package main
+
+import "testing"
+
+func TestPrefixCity(t *testing.T) {
+	cities := []*cityConfig{{Name: "jaipur"}, {Name: "pune"}}
+	tests := []struct {
+		prefix string
+		want   string
+	}{
+		{prefix: "20250101-120000-pune", want: "pune"},
+		{prefix: "20250101-120000-jaipur", want: "jaipur"},
+		// before multi city support
+		{prefix: "20250101-120000", want: defaultCityName},
+		{prefix: "20250101-120000-delhi", want: defaultCityName},
+	}
+
+	for _, tt := range tests {
+		if got := prefixCity(tt.prefix, cities); got != tt.want {
+			t.Errorf("prefixCity(%q) = %q, want %q", tt.prefix, got, tt.want)
+		}
+	}
+}
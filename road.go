@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"io/fs"
+	"log"
+	"path/filepath"
+	"strings"
+)
+
+// A road mask is the reference of all the road pixels in the cropped region of a
+// cell. It is built by OR-ing the colored pixels of the masks of the cell over many
+// rounds, or from a round without traffic where all the roads are colored green.
+// The traffic counts are normalised by the road pixels to compare cells.
+const (
+	roadValueInMask = uint8(255)
+)
+
+func roadMaskPath(city string, x, y int) string {
+	return fmt.Sprintf(fileNameFmt, roadMaskFolder, city, x, y)
+}
+
+func newRoadMask() *image.Gray {
+	return image.NewGray(image.Rect(0, 0, imageWidthWithLeaveOuts, imageHeightWithLeaveOuts))
+}
+
+// readRoadMask returns the road mask of the cell, an empty mask if there is none yet.
+func readRoadMask(city string, x, y int) (*image.Gray, error) {
+	img, err := readImage(roadMaskPath(city, x, y))
+	if errors.Is(err, fs.ErrNotExist) {
+		return newRoadMask(), nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if gray, ok := img.(*image.Gray); ok {
+		return gray, nil
+	}
+	roadMask := newRoadMask()
+	draw.Draw(roadMask, roadMask.Bounds(), img, img.Bounds().Min, draw.Src)
+	return roadMask, nil
+}
+
+// updateRoadMask adds the colored pixels of the mask of the cell to its road mask.
+func updateRoadMask(city string, x, y int, mask *image.Gray) (*image.Gray, error) {
+	roadMask, err := readRoadMask(city, x, y)
+	if err != nil {
+		return nil, err
+	}
+
+	croppedMask := cropImage(mask)
+	orMask(roadMask, croppedMask, croppedMask.Bounds().Min)
+	if err := savePNG(roadMaskPath(city, x, y), roadMask); err != nil {
+		return nil, fmt.Errorf("error in saving road mask: %w", err)
+	}
+
+	return roadMask, nil
+}
+
+// orMask marks the pixels of the road mask that are colored in the mask starting at sp.
+func orMask(roadMask, mask *image.Gray, sp image.Point) {
+	bounds := roadMask.Bounds()
+	for y := range bounds.Dy() {
+		roadPix := roadMask.Pix[roadMask.PixOffset(bounds.Min.X, bounds.Min.Y+y):]
+		maskPix := mask.Pix[mask.PixOffset(sp.X, sp.Y+y):]
+		for i := range bounds.Dx() {
+			if maskPix[i] != 0 {
+				roadPix[i] = roadValueInMask
+			}
+		}
+	}
+}
+
+func countRoadPixels(roadMask *image.Gray) int {
+	count := 0
+	for _, v := range roadMask.Pix {
+		if v != 0 {
+			count++
+		}
+	}
+	return count
+}
+
+// roadPixels returns the number of road pixels of the cell, 0 if there is no road mask.
+func roadPixels(city string, x, y int) (int, error) {
+	roadMask, err := readRoadMask(city, x, y)
+	if err != nil {
+		return 0, err
+	}
+	return countRoadPixels(roadMask), nil
+}
+
+// rebuildRoadMasks replaces the road masks of the city with the OR of the combined
+// masks of the city whose name starts with the prefix, all of them if it is empty.
+// The prefix of a round without traffic builds the road masks from that round only.
+// The segment maps are rebuilt from the new road masks, renumbering the segments.
+func rebuildRoadMasks(ctx context.Context, city *cityConfig, prefix string, db *sql.DB) error {
+	log.Printf("---- rebuilding road masks for %v from masks in [%v] ----", city.Name, maskCombFolder)
+	defer log.Println("---- road masks rebuilt ----")
+
+	numCols, numRows := 0, 0
+	for _, cell := range city.cells() {
+		numCols = max(numCols, cell.X+1)
+		numRows = max(numRows, cell.Y+1)
+	}
+	combinedRoadMask := image.NewGray(image.Rect(0, 0,
+		numCols*imageWidthWithLeaveOuts, numRows*imageHeightWithLeaveOuts))
+
+	numFiles := 0
+	if err := filepath.WalkDir(maskCombFolder, func(maskCombPath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return fmt.Errorf("error in walking dir [%v]: %w", maskCombFolder, err)
+		}
+		if d.IsDir() || !strings.HasPrefix(d.Name(), prefix) || !strings.HasSuffix(d.Name(), "-"+city.Name+".png") {
+			return nil
+		}
+
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		img, err := readImage(maskCombPath)
+		if err != nil {
+			return err
+		}
+
+		mask := image.NewGray(combinedRoadMask.Bounds())
+		draw.Draw(mask, mask.Bounds(), img, img.Bounds().Min, draw.Src)
+		for x := range numCols {
+			for y := range numRows {
+				draw.Draw(mask, coordinatesRect(x, y), &image.Uniform{color.Gray{0}}, image.Point{}, draw.Src)
+			}
+		}
+
+		orMask(combinedRoadMask, mask, image.Point{})
+		numFiles++
+		return nil
+	}); err != nil {
+		return fmt.Errorf("error in walking dir for rebuilding road masks [%v]: %w", maskCombFolder, err)
+	}
+
+	log.Printf("combined [%v] masks of %v", numFiles, city.Name)
+	for _, cell := range city.cells() {
+		minX := cell.X * imageWidthWithLeaveOuts
+		minY := cell.Y * imageHeightWithLeaveOuts
+
+		roadMask := newRoadMask()
+		draw.Draw(roadMask, roadMask.Bounds(), combinedRoadMask, image.Point{minX, minY}, draw.Src)
+		if err := savePNG(roadMaskPath(city.Name, cell.X, cell.Y), roadMask); err != nil {
+			return fmt.Errorf("error in saving road mask: %w", err)
+		}
+		if _, err := saveSegmentMap(city.Name, cell.X, cell.Y, roadMask, nil); err != nil {
+			return err
+		}
+
+		if err := insertRoadMask(ctx, db, city.Name, cell.X, cell.Y, countRoadPixels(roadMask)); err != nil {
+			return fmt.Errorf("error in inserting road mask [%v, %v]: %w", cell.X, cell.Y, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	// the time zones of the schedule do not depend on the zoneinfo of the host
+	_ "time/tzdata"
+)
+
+const (
+	defaultScheduleTimezone       = "Asia/Kolkata"
+	defaultCaptureIntervalMinutes = 10
+
+	// a schedule with no capture within this long is invalid
+	maxScheduleLookahead = 7 * 24 * time.Hour
+
+	scheduleClockFmt     = "15:04"
+	minutesInDay         = 24 * 60
+	schedulePreviewTsFmt = "2006-01-02 15:04 MST"
+)
+
+// scheduleConfig defines when the rounds are captured. A round is captured every
+// interval_minutes, counted from midnight in the time zone of the schedule, except
+// in the windows. A window applies every day from its start to its end (exclusive),
+// in its own time zone if set, and either turns the capture off or captures every
+// interval_minutes of the window counted from its start. The first window that
+// contains a minute applies to it.
+type scheduleConfig struct {
+	Timezone        string           `json:"timezone"`
+	IntervalMinutes int              `json:"interval_minutes"`
+	Windows         []scheduleWindow `json:"windows"`
+
+	location *time.Location
+}
+
+type scheduleWindow struct {
+	// HH:MM, the window wraps around midnight if the end is before the start
+	Start           string `json:"start"`
+	End             string `json:"end"`
+	Timezone        string `json:"timezone,omitempty"`
+	IntervalMinutes int    `json:"interval_minutes,omitempty"`
+	Off             bool   `json:"off,omitempty"`
+
+	location *time.Location
+	// minutes since midnight
+	start, end int
+}
+
+// defaultScheduleConfig captures every 10 minutes, every 30 minutes
+// from 11:30PM to 1:30AM and not at all from 2:30AM to 6:30AM IST.
+func defaultScheduleConfig() scheduleConfig {
+	return scheduleConfig{
+		Timezone:        defaultScheduleTimezone,
+		IntervalMinutes: defaultCaptureIntervalMinutes,
+		Windows: []scheduleWindow{
+			{Start: "23:30", End: "01:30", IntervalMinutes: 30},
+			{Start: "02:30", End: "06:30", Off: true},
+		},
+	}
+}
+
+// validate parses the time zones and the windows of the schedule.
+func (s *scheduleConfig) validate() error {
+	location, err := time.LoadLocation(s.Timezone)
+	if err != nil {
+		return fmt.Errorf("invalid time zone [%v] of the schedule: %w", s.Timezone, err)
+	}
+	s.location = location
+	if s.IntervalMinutes <= 0 {
+		return fmt.Errorf("interval of the schedule must be positive")
+	}
+
+	for i := range s.Windows {
+		w := &s.Windows[i]
+		if err := w.validate(location); err != nil {
+			return fmt.Errorf("window [%v-%v] of the schedule: %w", w.Start, w.End, err)
+		}
+	}
+
+	if _, err := s.next(time.Now()); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (w *scheduleWindow) validate(defaultLocation *time.Location) error {
+	w.location = defaultLocation
+	if w.Timezone != "" {
+		location, err := time.LoadLocation(w.Timezone)
+		if err != nil {
+			return fmt.Errorf("invalid time zone [%v]: %w", w.Timezone, err)
+		}
+		w.location = location
+	}
+
+	var err error
+	if w.start, err = parseClock(w.Start); err != nil {
+		return err
+	}
+	if w.end, err = parseClock(w.End); err != nil {
+		return err
+	}
+	if w.start == w.end {
+		return fmt.Errorf("start and end must differ")
+	}
+	if w.IntervalMinutes < 0 || (!w.Off && w.IntervalMinutes == 0) {
+		return fmt.Errorf("interval must be positive unless the window is off")
+	}
+	return nil
+}
+
+func parseClock(clock string) (int, error) {
+	t, err := time.Parse(scheduleClockFmt, clock)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time [%v], expected HH:MM", clock)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func (w *scheduleWindow) contains(minute int) bool {
+	if w.start < w.end {
+		return minute >= w.start && minute < w.end
+	}
+	return minute >= w.start || minute < w.end
+}
+
+// window returns the window that applies to the minute of t, nil if none does.
+func (s *scheduleConfig) window(t time.Time) *scheduleWindow {
+	for i := range s.Windows {
+		w := &s.Windows[i]
+		if w.contains(minuteOfDay(t.In(w.location))) {
+			return w
+		}
+	}
+	return nil
+}
+
+// due returns whether a round is to be captured in the minute of t.
+func (s *scheduleConfig) due(t time.Time) bool {
+	w := s.window(t)
+	switch {
+	case w == nil:
+		return minuteOfDay(t.In(s.location))%s.IntervalMinutes == 0
+	case w.Off:
+		return false
+	default:
+		minute := minuteOfDay(t.In(w.location))
+		return ((minute-w.start+minutesInDay)%minutesInDay)%w.IntervalMinutes == 0
+	}
+}
+
+// intervalAt returns the interval between the rounds in the minute of t,
+// and false if the capture is off then.
+func (s *scheduleConfig) intervalAt(t time.Time) (time.Duration, bool) {
+	w := s.window(t)
+	switch {
+	case w == nil:
+		return s.interval(), true
+	case w.Off:
+		return 0, false
+	default:
+		return time.Duration(w.IntervalMinutes) * time.Minute, true
+	}
+}
+
+func minuteOfDay(t time.Time) int {
+	return t.Hour()*60 + t.Minute()
+}
+
+// next returns the start of the first minute after t in which a round is due.
+func (s *scheduleConfig) next(t time.Time) (time.Time, error) {
+	end := t.Add(maxScheduleLookahead)
+	for t = t.Truncate(time.Minute).Add(time.Minute); t.Before(end); t = t.Add(time.Minute) {
+		if s.due(t) {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("no capture in the schedule within [%v]", maxScheduleLookahead)
+}
+
+// nextAfter returns the start of the first minute, at least interval after t,
+// in which the capture is not off. It is used by the adaptive cadence in place
+// of the intervals of the schedule.
+func (s *scheduleConfig) nextAfter(t time.Time, interval time.Duration) (time.Time, error) {
+	start := t.Add(interval)
+	if start.Truncate(time.Minute).Before(start) {
+		start = start.Truncate(time.Minute).Add(time.Minute)
+	}
+
+	end := start.Add(maxScheduleLookahead)
+	for t = start; t.Before(end); t = t.Add(time.Minute) {
+		if _, on := s.intervalAt(t); on {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("no capture in the schedule within [%v]", maxScheduleLookahead)
+}
+
+// interval is the time between the rounds outside of the windows.
+func (s *scheduleConfig) interval() time.Duration {
+	return time.Duration(s.IntervalMinutes) * time.Minute
+}
+
+// previewSchedule writes the next count capture times after now,
+// with the time since the previous capture.
+func previewSchedule(s *scheduleConfig, now time.Time, count int, w io.Writer) error {
+	t := now
+	for range count {
+		next, err := s.next(t)
+		if err != nil {
+			return err
+		}
+
+		gap := "-"
+		if t != now {
+			gap = next.Sub(t).String()
+		}
+		if _, err := fmt.Fprintf(w, "%v\t%v\n", next.In(s.location).Format(schedulePreviewTsFmt), gap); err != nil {
+			return fmt.Errorf("error in writing schedule preview: %w", err)
+		}
+		t = next
+	}
+	return nil
+}
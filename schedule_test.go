@@ -0,0 +1,203 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func newTestSchedule(t *testing.T, s scheduleConfig) *scheduleConfig {
+	t.Helper()
+	if err := s.validate(); err != nil {
+		t.Fatal(err)
+	}
+	return &s
+}
+
+func mustLoadLocation(t *testing.T, name string) *time.Location {
+	t.Helper()
+	location, err := time.LoadLocation(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return location
+}
+
+func TestScheduleWindowContains(t *testing.T) {
+	wrapping := scheduleWindow{Start: "23:30", End: "01:30", IntervalMinutes: 30}
+	daytime := scheduleWindow{Start: "02:30", End: "06:30", Off: true}
+	for _, w := range []*scheduleWindow{&wrapping, &daytime} {
+		if err := w.validate(time.UTC); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		window *scheduleWindow
+		clock  string
+		want   bool
+	}{
+		{&wrapping, "23:29", false},
+		{&wrapping, "23:30", true},
+		{&wrapping, "00:00", true},
+		{&wrapping, "01:29", true},
+		{&wrapping, "01:30", false},
+		{&wrapping, "12:00", false},
+		{&daytime, "02:29", false},
+		{&daytime, "02:30", true},
+		{&daytime, "06:29", true},
+		{&daytime, "06:30", false},
+	}
+
+	for _, tt := range tests {
+		minute, err := parseClock(tt.clock)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := tt.window.contains(minute); got != tt.want {
+			t.Errorf("window [%v-%v] contains %v = %v, want %v", tt.window.Start, tt.window.End, tt.clock, got, tt.want)
+		}
+	}
+}
+
+func TestScheduleDue(t *testing.T) {
+	s := newTestSchedule(t, defaultScheduleConfig())
+	ist := mustLoadLocation(t, defaultScheduleTimezone)
+
+	tests := []struct {
+		clock        string
+		due          bool
+		interval     time.Duration
+		intervalOkay bool
+	}{
+		{"10:00", true, 10 * time.Minute, true},
+		{"10:05", false, 10 * time.Minute, true},
+		{"23:20", true, 10 * time.Minute, true},
+		// every 30 minutes from the start of the window, across midnight
+		{"23:30", true, 30 * time.Minute, true},
+		{"23:40", false, 30 * time.Minute, true},
+		{"00:00", true, 30 * time.Minute, true},
+		{"00:10", false, 30 * time.Minute, true},
+		{"01:00", true, 30 * time.Minute, true},
+		// the end of the window is back to every 10 minutes
+		{"01:30", true, 10 * time.Minute, true},
+		{"01:40", true, 10 * time.Minute, true},
+		{"02:30", false, 0, false},
+		{"06:20", false, 0, false},
+		{"06:30", true, 10 * time.Minute, true},
+	}
+
+	for _, tt := range tests {
+		minute, err := parseClock(tt.clock)
+		if err != nil {
+			t.Fatal(err)
+		}
+		at := time.Date(2025, 1, 2, minute/60, minute%60, 0, 0, ist)
+		if got := s.due(at); got != tt.due {
+			t.Errorf("due at %v = %v, want %v", tt.clock, got, tt.due)
+		}
+		if interval, ok := s.intervalAt(at); interval != tt.interval || ok != tt.intervalOkay {
+			t.Errorf("interval at %v = %v, %v, want %v, %v", tt.clock, interval, ok, tt.interval, tt.intervalOkay)
+		}
+	}
+}
+
+func TestScheduleWindowTimezone(t *testing.T) {
+	// office hours in New York are off, hourly captures in UTC otherwise
+	s := newTestSchedule(t, scheduleConfig{
+		Timezone:        "UTC",
+		IntervalMinutes: 60,
+		Windows:         []scheduleWindow{{Start: "09:00", End: "17:00", Timezone: "America/New_York", Off: true}},
+	})
+
+	tests := []struct {
+		at   time.Time
+		want bool
+	}{
+		// 08:00 EST and 09:00 EDT
+		{time.Date(2025, 1, 15, 13, 0, 0, 0, time.UTC), true},
+		{time.Date(2025, 7, 15, 13, 0, 0, 0, time.UTC), false},
+		// 16:00 EST and 17:00 EDT
+		{time.Date(2025, 1, 15, 21, 0, 0, 0, time.UTC), false},
+		{time.Date(2025, 7, 15, 21, 0, 0, 0, time.UTC), true},
+		{time.Date(2025, 1, 15, 21, 30, 0, 0, time.UTC), false},
+	}
+
+	for _, tt := range tests {
+		if got := s.due(tt.at); got != tt.want {
+			t.Errorf("due at %v = %v, want %v", tt.at, got, tt.want)
+		}
+	}
+}
+
+func TestScheduleNext(t *testing.T) {
+	s := newTestSchedule(t, defaultScheduleConfig())
+	ist := mustLoadLocation(t, defaultScheduleTimezone)
+	at := func(day, hour, minute, second int) time.Time {
+		return time.Date(2025, 1, day, hour, minute, second, 0, ist)
+	}
+
+	tests := []struct {
+		name string
+		from time.Time
+		want time.Time
+	}{
+		{"next interval", at(2, 10, 0, 0), at(2, 10, 10, 0)},
+		{"within a minute", at(2, 10, 9, 59), at(2, 10, 10, 0)},
+		{"into the window", at(2, 23, 25, 0), at(2, 23, 30, 0)},
+		{"across midnight", at(2, 23, 35, 0), at(3, 0, 0, 0)},
+		{"over the off window", at(3, 2, 25, 0), at(3, 6, 30, 0)},
+	}
+
+	for _, tt := range tests {
+		got, err := s.next(tt.from)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !got.Equal(tt.want) {
+			t.Errorf("%v: next after %v = %v, want %v", tt.name, tt.from, got, tt.want)
+		}
+	}
+}
+
+func TestScheduleWithoutDueMinute(t *testing.T) {
+	// the only minute outside of the off window is not on the hourly interval
+	s := scheduleConfig{
+		Timezone:        "UTC",
+		IntervalMinutes: 60,
+		Windows:         []scheduleWindow{{Start: "00:00", End: "23:59", Off: true}},
+	}
+	if err := s.validate(); err == nil {
+		t.Error("validate() of a schedule without any capture succeeded")
+	}
+}
+
+func TestScheduleNextAfter(t *testing.T) {
+	s := newTestSchedule(t, defaultScheduleConfig())
+	ist := mustLoadLocation(t, defaultScheduleTimezone)
+	at := func(hour, minute, second int) time.Time {
+		return time.Date(2025, 1, 2, hour, minute, second, 0, ist)
+	}
+
+	tests := []struct {
+		name     string
+		from     time.Time
+		interval time.Duration
+		want     time.Time
+	}{
+		{"not on the schedule interval", at(10, 0, 0), 7 * time.Minute, at(10, 7, 0)},
+		{"rounded up to the minute", at(10, 0, 30), 7 * time.Minute, at(10, 8, 0)},
+		{"inside a window that is on", at(23, 0, 0), time.Hour, at(0, 0, 0).AddDate(0, 0, 1)},
+		{"into the off window", at(1, 0, 0).AddDate(0, 0, 1), 2 * time.Hour, at(6, 30, 0).AddDate(0, 0, 1)},
+		{"longer than the off window", at(2, 0, 0), 5 * time.Hour, at(7, 0, 0)},
+	}
+
+	for _, tt := range tests {
+		got, err := s.nextAfter(tt.from, tt.interval)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !got.Equal(tt.want) {
+			t.Errorf("%v: next after %v by %v = %v, want %v", tt.name, tt.from, tt.interval, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"io/fs"
+	"log"
+	"math"
+	"sort"
+)
+
+// A segment map assigns every road pixel of a cell to a road segment. The road mask
+// of the cell is thinned to a skeleton one pixel wide, the skeleton is split into
+// branches at the junctions, and each branch is labeled as a segment in raster order.
+// The road pixels are then assigned to the nearest branch. The map is stored as a
+// 16 bit gray image, 0 is no road and roadWithoutSegment is a road pixel too far
+// from any branch. The map is rebuilt as the road mask grows, a branch keeps the
+// label of the old map that most of its pixels had so that the segment IDs are
+// stable across rounds.
+const (
+	// shorter branches are spurs of the skeleton at the edges of wide roads
+	minSegmentPixels = 15
+
+	roadWithoutSegment = math.MaxUint16
+
+	// growth of the road pixels of a cell since its segment map was built after
+	// which the map is rebuilt with the new roads
+	segmentMapRebuildGrowth = 0.1
+)
+
+// segmentCounts is the number of pixels of each traffic class in a road segment.
+type segmentCounts struct {
+	ID int
+	trafficCounts
+}
+
+func segmentMapPath(city string, x, y int) string {
+	return fmt.Sprintf(fileNameFmt, segmentFolder, city, x, y)
+}
+
+// readSegmentMap returns the segment map of the cell, nil if there is none yet.
+func readSegmentMap(city string, x, y int) (*image.Gray16, error) {
+	img, err := readImage(segmentMapPath(city, x, y))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	segments, ok := img.(*image.Gray16)
+	if !ok {
+		return nil, fmt.Errorf("segment map [%v] is not a 16 bit gray image", segmentMapPath(city, x, y))
+	}
+	return segments, nil
+}
+
+// segmentMap returns the segment map of the cell, it is built from the road mask
+// if the cell does not have one yet or the road mask has grown since it was built.
+func segmentMap(city string, x, y int, roadMask *image.Gray) (*image.Gray16, error) {
+	segments, err := readSegmentMap(city, x, y)
+	if err != nil {
+		return nil, err
+	}
+	if segments == nil {
+		return saveSegmentMap(city, x, y, roadMask, nil)
+	}
+
+	built, roads := countSegmentMapPixels(segments), countRoadPixels(roadMask)
+	if float64(roads-built) <= segmentMapRebuildGrowth*float64(built) {
+		return segments, nil
+	}
+	log.Printf("rebuilding segment map [%v, %v] of %v as road pixels grew from [%v] to [%v]",
+		x, y, city, built, roads)
+	return saveSegmentMap(city, x, y, roadMask, segments)
+}
+
+// saveSegmentMap builds and saves the segment map of the cell, keeping the
+// segment IDs of the previous map of the cell if it is not nil.
+func saveSegmentMap(city string, x, y int, roadMask *image.Gray, previous *image.Gray16) (*image.Gray16, error) {
+	segments := buildSegmentMap(roadMask, previous)
+	if err := savePNG(segmentMapPath(city, x, y), segments); err != nil {
+		return nil, fmt.Errorf("error in saving segment map: %w", err)
+	}
+	return segments, nil
+}
+
+// countSegmentMapPixels returns the number of road pixels the segment map was built from.
+func countSegmentMapPixels(segments *image.Gray16) int {
+	count := 0
+	for i := 0; i+1 < len(segments.Pix); i += 2 {
+		if segments.Pix[i] != 0 || segments.Pix[i+1] != 0 {
+			count++
+		}
+	}
+	return count
+}
+
+func buildSegmentMap(roadMask *image.Gray, previous *image.Gray16) *image.Gray16 {
+	bounds := roadMask.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+
+	road := make([]bool, w*h)
+	for y := range h {
+		pix := roadMask.Pix[roadMask.PixOffset(bounds.Min.X, bounds.Min.Y+y):]
+		for x := range w {
+			road[y*w+x] = pix[x] != 0
+		}
+	}
+
+	// junctions, the skeleton pixels with more than two neighbours, split the branches
+	skeleton := skeletonize(road, w, h)
+	branch := make([]bool, w*h)
+	for i, ok := range skeleton {
+		branch[i] = ok && countNeighbours(skeleton, w, h, i%w, i/w) <= 2
+	}
+
+	visited := make([]bool, w*h)
+	var components [][]int
+	for i := range branch {
+		if !branch[i] || visited[i] {
+			continue
+		}
+
+		visited[i] = true
+		component := []int{i}
+		for j := 0; j < len(component); j++ {
+			forNeighbours(w, h, component[j], true, func(n int) {
+				if branch[n] && !visited[n] {
+					visited[n] = true
+					component = append(component, n)
+				}
+			})
+		}
+		if len(component) >= minSegmentPixels {
+			components = append(components, component)
+		}
+	}
+
+	labels := make([]uint16, w*h)
+	var queue []int
+	for k, id := range segmentIDs(components, previous, w) {
+		if id == 0 {
+			continue
+		}
+		for _, p := range components[k] {
+			labels[p] = id
+		}
+		queue = append(queue, components[k]...)
+	}
+
+	// breadth first search from the branches assigns each road pixel to the nearest one
+	for j := 0; j < len(queue); j++ {
+		p := queue[j]
+		forNeighbours(w, h, p, false, func(n int) {
+			if road[n] && labels[n] == 0 {
+				labels[n] = labels[p]
+				queue = append(queue, n)
+			}
+		})
+	}
+
+	segments := image.NewGray16(image.Rect(0, 0, w, h))
+	for i, label := range labels {
+		if road[i] && label == 0 {
+			label = roadWithoutSegment
+		}
+		segments.Pix[2*i] = uint8(label >> 8)
+		segments.Pix[2*i+1] = uint8(label)
+	}
+	return segments
+}
+
+// segmentIDs returns the ID of each branch, 0 if there are no IDs left. A branch takes
+// the label of the previous map that most of its pixels had, the largest overlap wins
+// if a label is shared, the rest are labeled in raster order after the previous labels.
+func segmentIDs(components [][]int, previous *image.Gray16, w int) []uint16 {
+	ids := make([]uint16, len(components))
+	next := uint16(1)
+	if previous != nil && previous.Bounds().Dx() == w {
+		type match struct {
+			component int
+			id        uint16
+			overlap   int
+		}
+
+		var matches []match
+		for k, component := range components {
+			overlaps := make(map[uint16]int)
+			for _, p := range component {
+				pt := previous.Bounds().Min.Add(image.Point{p % w, p / w})
+				if id := previous.Gray16At(pt.X, pt.Y).Y; id != 0 && id != roadWithoutSegment {
+					overlaps[id]++
+				}
+			}
+			for id, overlap := range overlaps {
+				matches = append(matches, match{k, id, overlap})
+			}
+		}
+		sort.Slice(matches, func(i, j int) bool {
+			if matches[i].overlap != matches[j].overlap {
+				return matches[i].overlap > matches[j].overlap
+			}
+			if matches[i].component != matches[j].component {
+				return matches[i].component < matches[j].component
+			}
+			return matches[i].id < matches[j].id
+		})
+
+		taken := make(map[uint16]bool)
+		for _, m := range matches {
+			if ids[m.component] == 0 && !taken[m.id] {
+				ids[m.component] = m.id
+				taken[m.id] = true
+			}
+		}
+
+		// the labels of the segments that are gone are not reused
+		for i := 0; i+1 < len(previous.Pix); i += 2 {
+			if id := uint16(previous.Pix[i])<<8 | uint16(previous.Pix[i+1]); id != roadWithoutSegment {
+				next = max(next, id+1)
+			}
+		}
+	}
+
+	for k := range ids {
+		if ids[k] == 0 && next < roadWithoutSegment {
+			ids[k] = next
+			next++
+		}
+	}
+	return ids
+}
+
+// skeletonize thins the pixels to lines one pixel wide with the Zhang-Suen algorithm.
+func skeletonize(pixels []bool, w, h int) []bool {
+	skeleton := make([]bool, len(pixels))
+	copy(skeleton, pixels)
+
+	at := func(x, y int) bool {
+		return x >= 0 && y >= 0 && x < w && y < h && skeleton[y*w+x]
+	}
+
+	for changed := true; changed; {
+		changed = false
+		for step := range 2 {
+			var removed []int
+			for i, ok := range skeleton {
+				if !ok {
+					continue
+				}
+
+				x, y := i%w, i/w
+				// neighbours clockwise starting from the top
+				n := [8]bool{at(x, y-1), at(x+1, y-1), at(x+1, y), at(x+1, y+1),
+					at(x, y+1), at(x-1, y+1), at(x-1, y), at(x-1, y-1)}
+				count, transitions := 0, 0
+				for k := range n {
+					if n[k] {
+						count++
+					}
+					if !n[k] && n[(k+1)%8] {
+						transitions++
+					}
+				}
+				if count < 2 || count > 6 || transitions != 1 {
+					continue
+				}
+
+				top, right, bottom, left := n[0], n[2], n[4], n[6]
+				if step == 0 && (top && right && bottom || right && bottom && left) {
+					continue
+				}
+				if step == 1 && (top && right && left || top && bottom && left) {
+					continue
+				}
+				removed = append(removed, i)
+			}
+
+			for _, i := range removed {
+				skeleton[i] = false
+			}
+			changed = changed || len(removed) > 0
+		}
+	}
+
+	return skeleton
+}
+
+func countNeighbours(pixels []bool, w, h, x, y int) int {
+	count := 0
+	forNeighbours(w, h, y*w+x, true, func(n int) {
+		if pixels[n] {
+			count++
+		}
+	})
+	return count
+}
+
+// forNeighbours calls fn with the index of each of the 4, or 8 if diagonal is set,
+// neighbours of the pixel at index i that are within the image.
+func forNeighbours(w, h, i int, diagonal bool, fn func(n int)) {
+	x, y := i%w, i/w
+	for dy := -1; dy <= 1; dy++ {
+		for dx := -1; dx <= 1; dx++ {
+			if dx == 0 && dy == 0 || !diagonal && dx != 0 && dy != 0 {
+				continue
+			}
+			nx, ny := x+dx, y+dy
+			if nx < 0 || ny < 0 || nx >= w || ny >= h {
+				continue
+			}
+			fn(ny*w + nx)
+		}
+	}
+}
+
+// countSegmentTraffic counts the pixels of each traffic class of the mask starting
+// at sp in each segment of the segment map. The segments without any traffic
+// colored pixels are left out, the result is sorted by the segment ID.
+func countSegmentTraffic(mask *image.Gray, sp image.Point, segments *image.Gray16) []segmentCounts {
+	counts := make(map[int]*segmentCounts)
+	bounds := segments.Bounds()
+	for y := range bounds.Dy() {
+		for x := range bounds.Dx() {
+			id := int(segments.Gray16At(bounds.Min.X+x, bounds.Min.Y+y).Y)
+			if id == 0 || id == roadWithoutSegment {
+				continue
+			}
+
+			c, ok := counts[id]
+			if !ok {
+				c = &segmentCounts{ID: id}
+				counts[id] = c
+			}
+			c.RoadPixels++
+
+			switch mask.GrayAt(sp.X+x, sp.Y+y).Y {
+			case greenValueInMask:
+				c.Green++
+			case yellowValueInMask:
+				c.Yellow++
+			case redValueInMask:
+				c.Red++
+			case darkRedValueInMask:
+				c.DarkRed++
+			}
+		}
+	}
+
+	result := make([]segmentCounts, 0, len(counts))
+	for _, c := range counts {
+		if c.coloredPixels() > 0 {
+			result = append(result, *c)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].ID < result[j].ID })
+	return result
+}
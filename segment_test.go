@@ -0,0 +1,57 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"testing"
+)
+
+// addRoad draws a horizontal road five pixels wide between the rows y and y+5.
+func addRoad(roadMask *image.Gray, y int) {
+	draw.Draw(roadMask, image.Rect(10, y, 200, y+5), &image.Uniform{color.Gray{roadValueInMask}},
+		image.Point{}, draw.Src)
+}
+
+// segmentIDAt returns the segment ID of the pixel in the middle of the road at row y.
+func segmentIDAt(segments *image.Gray16, y int) uint16 {
+	return segments.Gray16At(100, y+2).Y
+}
+
+func TestBuildSegmentMapKeepsIDs(t *testing.T) {
+	roadMask := newRoadMask()
+	addRoad(roadMask, 100)
+	segments := buildSegmentMap(roadMask, nil)
+	if id := segmentIDAt(segments, 100); id != 1 {
+		t.Fatalf("segment ID of the road = %v, want 1", id)
+	}
+	if got, want := countSegmentMapPixels(segments), countRoadPixels(roadMask); got != want {
+		t.Errorf("segment map has [%v] road pixels, want %v", got, want)
+	}
+
+	// a new road before the old one in raster order
+	addRoad(roadMask, 20)
+	rebuilt := buildSegmentMap(roadMask, segments)
+	if id := segmentIDAt(rebuilt, 100); id != 1 {
+		t.Errorf("segment ID of the old road = %v, want 1", id)
+	}
+	if id := segmentIDAt(rebuilt, 20); id != 2 {
+		t.Errorf("segment ID of the new road = %v, want 2", id)
+	}
+	if id := segmentIDAt(buildSegmentMap(roadMask, nil), 20); id != 1 {
+		t.Errorf("segment ID of the new road without the previous map = %v, want 1", id)
+	}
+}
+
+func TestBuildSegmentMapMarksRoadWithoutSegment(t *testing.T) {
+	roadMask := newRoadMask()
+	roadMask.SetGray(50, 50, color.Gray{roadValueInMask})
+
+	segments := buildSegmentMap(roadMask, nil)
+	if id := segments.Gray16At(50, 50).Y; id != roadWithoutSegment {
+		t.Errorf("segment ID of a road pixel without segment = %v, want %v", id, roadWithoutSegment)
+	}
+	if got := countSegmentTraffic(image.NewGray(roadMask.Bounds()), image.Point{}, segments); len(got) != 0 {
+		t.Errorf("countSegmentTraffic() = %+v, want none", got)
+	}
+}
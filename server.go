@@ -0,0 +1,321 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const (
+	shutdownTimeout = 10 * time.Second
+
+	maxDashboardRounds   = 500
+	defaultCellChartDays = 7
+
+	roundsSQL = `SELECT prefix, ts, coverage FROM capture_round
+		WHERE city = ? AND status = ? ORDER BY ts DESC LIMIT ?`
+	roundExistsSQL  = `SELECT COUNT(*) FROM capture_round WHERE city = ? AND prefix = ?`
+	roundTrafficSQL = `SELECT x, y, congestion, yellow_pct, red_pct, dark_red_pct FROM traffic
+		WHERE ss_path >= ? AND ss_path < ?`
+	cellTrafficSQL = `SELECT ts, green, yellow, red, dark_red, congestion FROM traffic
+		WHERE city = ? AND x = ? AND y = ? AND ts >= ? ORDER BY ts`
+)
+
+//go:embed web/index.html
+var dashboardHTML []byte
+
+// dashboardServer serves the dashboard page, the data it shows, the combined images and the API.
+type dashboardServer struct {
+	db     *sql.DB
+	cities []*cityConfig
+	health healthConfig
+}
+
+type dashboardRound struct {
+	Prefix   string  `json:"prefix"`
+	Ts       string  `json:"ts"`
+	Coverage float64 `json:"coverage"`
+}
+
+type dashboardGrid struct {
+	City      string          `json:"city"`
+	Prefix    string          `json:"prefix"`
+	NumCols   int             `json:"num_cols"`
+	NumRows   int             `json:"num_rows"`
+	Cells     []dashboardCell `json:"cells"`
+	SsImage   string          `json:"ss_image,omitempty"`
+	MaskImage string          `json:"mask_image,omitempty"`
+}
+
+type dashboardCell struct {
+	X          int      `json:"x"`
+	Y          int      `json:"y"`
+	Congestion *float64 `json:"congestion"`
+	YellowPct  *float64 `json:"yellow_pct"`
+	RedPct     *float64 `json:"red_pct"`
+	DarkRedPct *float64 `json:"dark_red_pct"`
+}
+
+type dashboardPoint struct {
+	Ts         string   `json:"ts"`
+	Green      *int     `json:"green"`
+	Yellow     int      `json:"yellow"`
+	Red        int      `json:"red"`
+	DarkRed    int      `json:"dark_red"`
+	Congestion *float64 `json:"congestion"`
+}
+
+func newDashboardServer(db *sql.DB, cities []*cityConfig, health healthConfig) *dashboardServer {
+	return &dashboardServer{db: db, cities: cities, health: health}
+}
+
+func (s *dashboardServer) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /{$}", s.handleIndex)
+	mux.HandleFunc("GET /data/cities", s.handleCities)
+	mux.HandleFunc("GET /data/rounds", s.handleRounds)
+	mux.HandleFunc("GET /data/grid", s.handleGrid)
+	mux.HandleFunc("GET /data/cell", s.handleCell)
+	mux.Handle("GET /images/ss-comb/", http.StripPrefix("/images/ss-comb/", http.FileServer(http.Dir(ssCombFolder))))
+	mux.Handle("GET /images/mask-comb/", http.StripPrefix("/images/mask-comb/", http.FileServer(http.Dir(maskCombFolder))))
+	mux.Handle("GET /metrics", promhttp.Handler())
+	s.registerHealth(mux)
+	s.registerAPI(mux)
+	return mux
+}
+
+// serveDashboard runs the dashboard server on addr until the context is cancelled.
+func serveDashboard(ctx context.Context, addr string, db *sql.DB, cities []*cityConfig, health healthConfig) error {
+	return serveHTTP(ctx, "dashboard", addr, newDashboardServer(db, cities, health).handler())
+}
+
+// serveHTTP runs the named server on addr until the context is cancelled.
+func serveHTTP(ctx context.Context, name, addr string, handler http.Handler) error {
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: requestTimeout,
+	}
+
+	stop := context.AfterFunc(ctx, func() {
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			log.Printf("error in shutting down %v server: %v", name, err)
+		}
+	})
+	defer stop()
+
+	log.Printf("serving %v on [%v]", name, addr)
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("error in serving %v: %w", name, err)
+	}
+	log.Printf("shutting down %v server!", name)
+	return nil
+}
+
+func (s *dashboardServer) handleIndex(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if _, err := w.Write(dashboardHTML); err != nil {
+		log.Printf("error in writing dashboard page: %v", err)
+	}
+}
+
+func (s *dashboardServer) handleCities(w http.ResponseWriter, r *http.Request) {
+	names := make([]string, 0, len(s.cities))
+	for _, city := range s.cities {
+		names = append(names, city.Name)
+	}
+	writeJSON(w, names)
+}
+
+func (s *dashboardServer) handleRounds(w http.ResponseWriter, r *http.Request) {
+	city, err := s.city(r.URL.Query().Get("city"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	rows, err := s.db.QueryContext(r.Context(), roundsSQL, city.Name, roundStatusComplete, maxDashboardRounds)
+	if err != nil {
+		serverError(w, fmt.Errorf("error in querying rounds: %w", err))
+		return
+	}
+	defer closeRows(rows)
+
+	rounds := []dashboardRound{}
+	for rows.Next() {
+		var round dashboardRound
+		if err := rows.Scan(&round.Prefix, &round.Ts, &round.Coverage); err != nil {
+			serverError(w, fmt.Errorf("error scanning sqlite row: %w", err))
+			return
+		}
+		rounds = append(rounds, round)
+	}
+	if err := rows.Err(); err != nil {
+		serverError(w, fmt.Errorf("sqlite rows iteration error: %w", err))
+		return
+	}
+
+	// oldest first for the time slider
+	slices.Reverse(rounds)
+	writeJSON(w, rounds)
+}
+
+func (s *dashboardServer) handleGrid(w http.ResponseWriter, r *http.Request) {
+	city, err := s.city(r.URL.Query().Get("city"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	prefix := r.URL.Query().Get("prefix")
+	if prefix == "" {
+		http.Error(w, "prefix is required", http.StatusBadRequest)
+		return
+	}
+	// the prefix goes into the paths of the manifest and the images, only the rounds are allowed
+	var exists int
+	if err := s.db.QueryRowContext(r.Context(), roundExistsSQL, city.Name, prefix).Scan(&exists); err != nil {
+		serverError(w, fmt.Errorf("error in querying round: %w", err))
+		return
+	}
+	if exists == 0 {
+		http.Error(w, fmt.Sprintf("unknown round [%v] of %v", prefix, city.Name), http.StatusNotFound)
+		return
+	}
+
+	grid := dashboardGrid{City: city.Name, Prefix: prefix, Cells: []dashboardCell{}}
+	if manifest, err := readManifest(prefix); err == nil {
+		grid.NumCols, grid.NumRows = manifest.NumCols, manifest.NumRows
+	} else {
+		for _, cell := range city.cells() {
+			grid.NumCols = max(grid.NumCols, cell.X+1)
+			grid.NumRows = max(grid.NumRows, cell.Y+1)
+		}
+	}
+
+	from, to := roundCellRange(prefix)
+	rows, err := s.db.QueryContext(r.Context(), roundTrafficSQL, from, to)
+	if err != nil {
+		serverError(w, fmt.Errorf("error in querying traffic of round: %w", err))
+		return
+	}
+	defer closeRows(rows)
+
+	for rows.Next() {
+		var cell dashboardCell
+		if err := rows.Scan(&cell.X, &cell.Y, &cell.Congestion, &cell.YellowPct, &cell.RedPct, &cell.DarkRedPct); err != nil {
+			serverError(w, fmt.Errorf("error scanning sqlite row: %w", err))
+			return
+		}
+		grid.Cells = append(grid.Cells, cell)
+	}
+	if err := rows.Err(); err != nil {
+		serverError(w, fmt.Errorf("sqlite rows iteration error: %w", err))
+		return
+	}
+
+	if fileExists(fmt.Sprintf(combFileNameFmt, ssCombFolder, prefix)) {
+		grid.SsImage = "/images/ss-comb/" + prefix + ".png"
+	}
+	if fileExists(fmt.Sprintf(combFileNameFmt, maskCombFolder, prefix)) {
+		grid.MaskImage = "/images/mask-comb/" + prefix + ".png"
+	}
+	writeJSON(w, grid)
+}
+
+func (s *dashboardServer) handleCell(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	city, err := s.city(query.Get("city"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	x, errX := strconv.Atoi(query.Get("x"))
+	y, errY := strconv.Atoi(query.Get("y"))
+	if errX != nil || errY != nil {
+		http.Error(w, "x and y must be integers", http.StatusBadRequest)
+		return
+	}
+	days := defaultCellChartDays
+	if query.Get("days") != "" {
+		if days, err = strconv.Atoi(query.Get("days")); err != nil || days <= 0 {
+			http.Error(w, "days must be a positive integer", http.StatusBadRequest)
+			return
+		}
+	}
+
+	from := time.Now().AddDate(0, 0, -days).Format(time.DateTime)
+	rows, err := s.db.QueryContext(r.Context(), cellTrafficSQL, city.Name, x, y, from)
+	if err != nil {
+		serverError(w, fmt.Errorf("error in querying traffic of cell: %w", err))
+		return
+	}
+	defer closeRows(rows)
+
+	points := []dashboardPoint{}
+	for rows.Next() {
+		var point dashboardPoint
+		if err := rows.Scan(&point.Ts, &point.Green, &point.Yellow, &point.Red, &point.DarkRed,
+			&point.Congestion); err != nil {
+			serverError(w, fmt.Errorf("error scanning sqlite row: %w", err))
+			return
+		}
+		points = append(points, point)
+	}
+	if err := rows.Err(); err != nil {
+		serverError(w, fmt.Errorf("sqlite rows iteration error: %w", err))
+		return
+	}
+	writeJSON(w, points)
+}
+
+// city returns the city with the name, the first city if the name is empty.
+func (s *dashboardServer) city(name string) (*cityConfig, error) {
+	for _, city := range s.cities {
+		if name == "" || city.Name == name {
+			return city, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown city [%v]", name)
+}
+
+// roundCellRange returns the [from, to) range of the ss_path of the cells of the round,
+// which are named prefix-xN-yN.png, so that the lookup uses the primary key.
+func roundCellRange(prefix string) (string, string) {
+	return prefix + "-x", prefix + "-y"
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("error in writing response: %v", err)
+	}
+}
+
+func serverError(w http.ResponseWriter, err error) {
+	log.Println(err)
+	http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+}
+
+func closeRows(rows *sql.Rows) {
+	if err := rows.Close(); err != nil {
+		log.Printf("error in closing rows: %v", err)
+	}
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestGridOnlyServesRounds(t *testing.T) {
+	db := newTestDB(t)
+	city := defaultConfig().Cities[0]
+	if _, err := db.Exec(`INSERT INTO capture_round(prefix, city, ts, status) VALUES(?, ?, ?, ?)`,
+		"20250102-150405-jaipur", city.Name, "2025-01-02 15:04:05", roundStatusComplete); err != nil {
+		t.Fatal(err)
+	}
+	handler := newDashboardServer(db, []*cityConfig{city}, defaultHealthConfig()).handler()
+
+	tests := []struct {
+		prefix string
+		status int
+	}{
+		{prefix: "20250102-150405-jaipur", status: http.StatusOK},
+		{prefix: "20250102-150405", status: http.StatusNotFound},
+		{prefix: "../../etc/passwd", status: http.StatusNotFound},
+		{prefix: "../manifest/20250102-150405-jaipur", status: http.StatusNotFound},
+		{prefix: "", status: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		query := url.Values{"city": {city.Name}, "prefix": {tt.prefix}}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/data/grid?"+query.Encode(), nil))
+		if rec.Code != tt.status {
+			t.Errorf("grid of prefix [%v] has status %v, want %v", tt.prefix, rec.Code, tt.status)
+		}
+	}
+}
@@ -1,42 +1,312 @@
 package main
 
-var (
-	lowFrequencyCells = map[int]map[int]int{
-		0:  {0: 0, 4: 0, 5: 0, 6: 0, 9: 0, 10: 0, 20: 0},
-		1:  {0: 0, 1: 0, 10: 0},
-		2:  {20: 0},
-		3:  {0: 0, 13: 0, 17: 0},
-		4:  {14: 0, 20: 0},
-		5:  {20: 0},
-		6:  {6: 0, 8: 0, 18: 0},
-		7:  {20: 0},
-		8:  {0: 1, 1: 1, 2: 1},
-		9:  {0: 1, 1: 1, 2: 1, 3: 1, 4: 1, 16: 1},
-		10: {0: 1, 1: 1, 11: 1, 12: 1, 13: 1, 14: 1},
-		11: {3: 1, 5: 1, 6: 1, 8: 1, 10: 1, 11: 1},
-		12: {3: 2, 5: 2, 6: 2, 7: 2, 9: 2, 12: 2, 13: 2, 20: 2},
-		13: {0: 2, 1: 2, 3: 2, 9: 2, 16: 2, 17: 2, 20: 2},
-		14: {0: 2, 5: 2, 12: 2, 13: 2, 14: 2, 17: 2},
-	}
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"image"
+	"log"
+	"math"
+	"sync"
+	"time"
 )
 
-func shouldSkip(x, y int) bool {
-	inner, exists := lowFrequencyCells[x]
-	if !exists {
-		return false
+const (
+	deleteSamplingPolicySQL = `DELETE FROM sampling_policy WHERE city = ?`
+	insertSamplingPolicySQL = `INSERT INTO sampling_policy(city, x, y, every, rounds, congestion_stddev,
+		road_coverage, updated_at) VALUES(?, ?, ?, ?, ?, ?, ?, ?)`
+	samplingPolicySQL = `SELECT city, x, y, every, updated_at FROM sampling_policy`
+
+	cellHistorySQL = `SELECT t.x, t.y, COUNT(*), AVG(t.congestion), AVG(t.congestion * t.congestion),
+		MAX(r.road_pixels) FROM traffic t LEFT JOIN road_mask r ON r.city = t.city AND r.x = t.x AND r.y = t.y
+		WHERE t.city = ? AND t.ts >= ? AND t.congestion IS NOT NULL GROUP BY t.x, t.y`
+)
+
+// samplingConfig decides how often each cell is captured. A cell whose congestion
+// barely varies, or which has little road in it, is captured once every few rounds.
+// The rates are computed from the history of the cells and refreshed periodically,
+// the rate of a cell in cells overrides the computed one.
+type samplingConfig struct {
+	HistoryDays  int `json:"history_days"`
+	RefreshHours int `json:"refresh_hours"`
+	// cells with fewer rounds in the history are captured in every round
+	MinRounds int `json:"min_rounds"`
+
+	// standard deviation of the congestion below which the cell varies little
+	LowCongestionStddev float64 `json:"low_congestion_stddev"`
+	// fraction of the pixels of the cell on the road below which the cell has little road
+	LowRoadCoverage float64 `json:"low_road_coverage"`
+	// a cell is captured at least once every max_every rounds
+	MaxEvery int `json:"max_every"`
+
+	Cells []cellSampling `json:"cells"`
+}
+
+// cellSampling captures the cell once every every rounds.
+type cellSampling struct {
+	City  string `json:"city"`
+	X     int    `json:"x"`
+	Y     int    `json:"y"`
+	Every int    `json:"every"`
+}
+
+func defaultSamplingConfig() samplingConfig {
+	return samplingConfig{
+		HistoryDays:         7,
+		RefreshHours:        24,
+		MinRounds:           100,
+		LowCongestionStddev: 0.02,
+		LowRoadCoverage:     0.01,
+		MaxEvery:            3,
 	}
+}
 
-	skipCount, exists := inner[y]
-	if !exists {
-		return false
+func (c samplingConfig) validate(cityNames map[string]struct{}) error {
+	if c.HistoryDays <= 0 || c.RefreshHours <= 0 || c.MinRounds < 0 {
+		return fmt.Errorf("sampling history and refresh must be positive")
+	}
+	if c.LowCongestionStddev < 0 || c.LowRoadCoverage < 0 || c.MaxEvery < 1 {
+		return fmt.Errorf("sampling thresholds must not be negative and max every must be positive")
+	}
+	for _, cell := range c.Cells {
+		if _, ok := cityNames[cell.City]; !ok {
+			return fmt.Errorf("sampling of cell [%v, %v] of unknown city [%v]", cell.X, cell.Y, cell.City)
+		}
+		if cell.Every < 1 {
+			return fmt.Errorf("sampling of cell [%v, %v] of %v must be positive", cell.X, cell.Y, cell.City)
+		}
+	}
+	return nil
+}
+
+// samplingPolicy is the rate at which each cell is captured. It is read by the
+// goroutines capturing the cells of a round while it may be refreshed.
+type samplingPolicy struct {
+	mu sync.RWMutex
+	// city => cell => the cell is captured once every these many rounds
+	every       map[string]map[image.Point]int
+	overrides   map[string]map[image.Point]int
+	refreshedAt map[string]time.Time
+	rounds      map[string]int
+	loaded      bool
+}
+
+// sampling is the policy used in capturing the rounds.
+var sampling = newSamplingPolicy()
+
+func newSamplingPolicy() *samplingPolicy {
+	return &samplingPolicy{
+		every:       make(map[string]map[image.Point]int),
+		overrides:   make(map[string]map[image.Point]int),
+		refreshedAt: make(map[string]time.Time),
+		rounds:      make(map[string]int),
 	}
+}
+
+// startRound returns the number of the round of the city, which picks the
+// cells captured in it.
+func (p *samplingPolicy) startRound(city string) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	round := p.rounds[city]
+	p.rounds[city]++
+	return round
+}
 
-	skipCount++
-	if skipCount >= 3 {
-		lowFrequencyCells[x][y] = 0
+// shouldSkip returns whether the cell is left out of the round. The cells
+// with the same rate are spread over the rounds by their position.
+func (p *samplingPolicy) shouldSkip(city string, x, y, round int) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	cell := image.Point{x, y}
+	every, ok := p.overrides[city][cell]
+	if !ok {
+		every = p.every[city][cell]
+	}
+	if every <= 1 {
 		return false
 	}
+	return (round+x+y)%every != 0
+}
+
+// refresh loads the policy from the db on the first call, and recomputes the
+// policy of the cities that were not refreshed for the refresh period.
+func (p *samplingPolicy) refresh(ctx context.Context, db *sql.DB, conf samplingConfig, cities []*cityConfig) error {
+	p.setOverrides(conf.Cells)
+	if err := p.load(ctx, db); err != nil {
+		return err
+	}
+
+	for _, city := range cities {
+		p.mu.RLock()
+		refreshedAt := p.refreshedAt[city.Name]
+		p.mu.RUnlock()
+		if time.Since(refreshedAt) < time.Duration(conf.RefreshHours)*time.Hour {
+			continue
+		}
+
+		every, err := computeSamplingPolicy(ctx, db, conf, city.Name)
+		if err != nil {
+			return fmt.Errorf("error in computing sampling policy of [%v]: %w", city.Name, err)
+		}
+
+		p.mu.Lock()
+		p.every[city.Name] = every
+		p.refreshedAt[city.Name] = time.Now()
+		p.mu.Unlock()
+	}
+	return nil
+}
+
+func (p *samplingPolicy) setOverrides(cells []cellSampling) {
+	overrides := make(map[string]map[image.Point]int)
+	for _, cell := range cells {
+		if overrides[cell.City] == nil {
+			overrides[cell.City] = make(map[image.Point]int)
+		}
+		overrides[cell.City][image.Point{cell.X, cell.Y}] = cell.Every
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.overrides = overrides
+}
+
+// load reads the policy persisted by an earlier run.
+func (p *samplingPolicy) load(ctx context.Context, db *sql.DB) error {
+	p.mu.RLock()
+	loaded := p.loaded
+	p.mu.RUnlock()
+	if loaded {
+		return nil
+	}
+
+	rows, err := db.QueryContext(ctx, samplingPolicySQL)
+	if err != nil {
+		return fmt.Errorf("error in querying sampling policy: %w", err)
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			log.Printf("error in closing rows: %v", err)
+		}
+	}()
+
+	every := make(map[string]map[image.Point]int)
+	refreshedAt := make(map[string]time.Time)
+	for rows.Next() {
+		var city, updatedAt string
+		var x, y, cellEvery int
+		if err := rows.Scan(&city, &x, &y, &cellEvery, &updatedAt); err != nil {
+			return fmt.Errorf("error scanning sqlite row: %w", err)
+		}
+		if every[city] == nil {
+			every[city] = make(map[image.Point]int)
+		}
+		every[city][image.Point{x, y}] = cellEvery
+		if ts, err := time.ParseInLocation(time.DateTime, updatedAt, time.Local); err == nil && ts.After(refreshedAt[city]) {
+			refreshedAt[city] = ts
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("sqlite rows iteration error: %w", err)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.every = every
+	p.refreshedAt = refreshedAt
+	p.loaded = true
+	return nil
+}
+
+// computeSamplingPolicy computes the rate of each cell of the city from its
+// history and replaces the persisted policy of the city.
+func computeSamplingPolicy(ctx context.Context, db *sql.DB, conf samplingConfig,
+	city string) (every map[image.Point]int, err error) {
+
+	since := time.Now().AddDate(0, 0, -conf.HistoryDays)
+	rows, err := db.QueryContext(ctx, cellHistorySQL, city, since.Format(time.DateTime))
+	if err != nil {
+		return nil, fmt.Errorf("error in querying history of cells: %w", err)
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			log.Printf("error in closing rows: %v", err)
+		}
+	}()
+
+	type cellHistory struct {
+		cell         image.Point
+		rounds       int
+		stddev       float64
+		roadCoverage float64
+	}
+	var history []cellHistory
+	for rows.Next() {
+		var h cellHistory
+		var mean, meanSquare float64
+		var roadPixels sql.NullInt64
+		if err := rows.Scan(&h.cell.X, &h.cell.Y, &h.rounds, &mean, &meanSquare, &roadPixels); err != nil {
+			return nil, fmt.Errorf("error scanning sqlite row: %w", err)
+		}
+		h.stddev = math.Sqrt(max(meanSquare-mean*mean, 0))
+		// the cells analyzed before the road masks existed count as full of road
+		h.roadCoverage = 1
+		if roadPixels.Valid {
+			h.roadCoverage = float64(roadPixels.Int64) / (imageWidthWithLeaveOuts * imageHeightWithLeaveOuts)
+		}
+		history = append(history, h)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("sqlite rows iteration error: %w", err)
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error in starting transaction: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
 
-	lowFrequencyCells[x][y] = skipCount
-	return true
+	if _, err = tx.ExecContext(ctx, deleteSamplingPolicySQL, city); err != nil {
+		return nil, fmt.Errorf("error in deleting sampling policy: %w", err)
+	}
+
+	every = make(map[image.Point]int)
+	updatedAt := time.Now().Format(time.DateTime)
+	for _, h := range history {
+		cellEvery := 1
+		if h.rounds >= conf.MinRounds {
+			if h.stddev < conf.LowCongestionStddev {
+				cellEvery++
+			}
+			if h.roadCoverage < conf.LowRoadCoverage {
+				cellEvery++
+			}
+		}
+		cellEvery = min(cellEvery, conf.MaxEvery)
+		every[h.cell] = cellEvery
+
+		if _, err = tx.ExecContext(ctx, insertSamplingPolicySQL, city, h.cell.X, h.cell.Y, cellEvery,
+			h.rounds, h.stddev, h.roadCoverage, updatedAt); err != nil {
+			return nil, fmt.Errorf("error in inserting sampling policy: %w", err)
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, fmt.Errorf("error in committing sampling policy: %w", err)
+	}
+
+	sampled := 0
+	for _, cellEvery := range every {
+		if cellEvery > 1 {
+			sampled++
+		}
+	}
+	log.Printf("computed sampling policy of %v, [%v] of [%v] cells are captured less often", city, sampled, len(every))
+	return every, nil
 }
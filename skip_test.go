@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"image"
+	"testing"
+	"time"
+)
+
+func TestComputeSamplingPolicy(t *testing.T) {
+	db := newTestDB(t)
+	free := trafficCounts{Green: 100}
+	busy := trafficCounts{Green: 50, Yellow: 30, Red: 20}
+	jammed := trafficCounts{Green: 20, Yellow: 20, Red: 30, DarkRed: 30}
+
+	steady, varying, littleRoad := image.Point{0, 0}, image.Point{1, 0}, image.Point{2, 0}
+	varyingLittleRoad, fewRounds := image.Point{3, 0}, image.Point{4, 0}
+	now := time.Now().Truncate(time.Second)
+	for i := range 4 {
+		cells := map[image.Point]trafficCounts{steady: busy, varying: free, littleRoad: busy, varyingLittleRoad: free}
+		if i%2 == 1 {
+			cells[varying], cells[varyingLittleRoad] = jammed, jammed
+		}
+		if i < 2 {
+			cells[fewRounds] = busy
+		}
+		insertTestRound(t, db, now.Add(-time.Duration(i+1)*time.Hour), cells)
+	}
+	// a round older than the history is left out
+	insertTestRound(t, db, now.AddDate(0, 0, -8), map[image.Point]trafficCounts{steady: jammed})
+	for _, cell := range []image.Point{littleRoad, varyingLittleRoad} {
+		if _, err := db.Exec(insertRoadMaskSQL, "jaipur", cell.X, cell.Y, 10, now.Format(time.DateTime)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := db.Exec(insertRoadMaskSQL, "jaipur", steady.X, steady.Y,
+		imageWidthWithLeaveOuts*imageHeightWithLeaveOuts/2, now.Format(time.DateTime)); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		maxEvery int
+		want     map[image.Point]int
+	}{
+		{
+			name:     "thresholds",
+			maxEvery: 3,
+			want:     map[image.Point]int{steady: 2, varying: 1, littleRoad: 3, varyingLittleRoad: 2, fewRounds: 1},
+		},
+		{
+			name:     "max every",
+			maxEvery: 2,
+			want:     map[image.Point]int{steady: 2, varying: 1, littleRoad: 2, varyingLittleRoad: 2, fewRounds: 1},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf := defaultSamplingConfig()
+			conf.MinRounds = 4
+			conf.MaxEvery = tt.maxEvery
+			every, err := computeSamplingPolicy(context.Background(), db, conf, "jaipur")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(every) != len(tt.want) {
+				t.Errorf("policy of %v cells, want %v", len(every), len(tt.want))
+			}
+			for cell, want := range tt.want {
+				if every[cell] != want {
+					t.Errorf("cell %v is captured every %v rounds, want %v", cell, every[cell], want)
+				}
+			}
+
+			// the policy is persisted for the next run
+			p := newSamplingPolicy()
+			if err := p.load(context.Background(), db); err != nil {
+				t.Fatal(err)
+			}
+			for cell, want := range tt.want {
+				if got := p.every["jaipur"][cell]; got != want {
+					t.Errorf("loaded cell %v is captured every %v rounds, want %v", cell, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestSamplingPolicyShouldSkip(t *testing.T) {
+	p := newSamplingPolicy()
+	p.every["jaipur"] = map[image.Point]int{{0, 0}: 1, {1, 0}: 3, {1, 1}: 3, {2, 0}: 2}
+
+	tests := []struct {
+		x, y int
+		// the rounds out of the first 6 in which the cell is captured
+		want []bool
+	}{
+		{0, 0, []bool{true, true, true, true, true, true}},
+		{1, 0, []bool{false, false, true, false, false, true}},
+		// the neighbouring cell with the same rate is captured in another round
+		{1, 1, []bool{false, true, false, false, true, false}},
+		{2, 0, []bool{true, false, true, false, true, false}},
+		// a cell without any policy is always captured
+		{5, 5, []bool{true, true, true, true, true, true}},
+	}
+
+	for _, tt := range tests {
+		for round, want := range tt.want {
+			if got := !p.shouldSkip("jaipur", tt.x, tt.y, round); got != want {
+				t.Errorf("cell [%v, %v] is captured in round %v = %v, want %v", tt.x, tt.y, round, got, want)
+			}
+		}
+	}
+	if p.shouldSkip("delhi", 1, 0, 0) {
+		t.Error("cell of a city without any policy is skipped")
+	}
+}
+
+func TestSamplingPolicyOverrides(t *testing.T) {
+	db := newTestDB(t)
+	now := time.Now().Truncate(time.Second)
+	for i := range 3 {
+		insertTestRound(t, db, now.Add(-time.Duration(i+1)*time.Hour), map[image.Point]trafficCounts{
+			{0, 0}: {Green: 100}, {1, 0}: {Green: 100},
+		})
+	}
+
+	conf := defaultSamplingConfig()
+	conf.MinRounds = 3
+	conf.Cells = []cellSampling{
+		{City: "jaipur", X: 0, Y: 0, Every: 1},
+		{City: "jaipur", X: 2, Y: 0, Every: 2},
+	}
+	p := newSamplingPolicy()
+	cities := []*cityConfig{defaultConfig().Cities[0]}
+	if err := p.refresh(context.Background(), db, conf, cities); err != nil {
+		t.Fatal(err)
+	}
+	if p.every["jaipur"][image.Point{0, 0}] != 2 || p.every["jaipur"][image.Point{1, 0}] != 2 {
+		t.Fatalf("computed policy = %v, want the steady cells every 2 rounds", p.every["jaipur"])
+	}
+
+	tests := []struct {
+		name string
+		x, y int
+		want []bool
+	}{
+		{"override over the computed rate", 0, 0, []bool{true, true, true, true}},
+		{"computed rate", 1, 0, []bool{false, true, false, true}},
+		{"override of a cell without history", 2, 0, []bool{true, false, true, false}},
+	}
+	for _, tt := range tests {
+		for round, want := range tt.want {
+			if got := !p.shouldSkip("jaipur", tt.x, tt.y, round); got != want {
+				t.Errorf("%v: cell [%v, %v] is captured in round %v = %v, want %v", tt.name, tt.x, tt.y, round, got, want)
+			}
+		}
+	}
+
+	// the overrides are replaced on the next refresh, without recomputing the policy
+	conf.Cells = nil
+	if err := p.refresh(context.Background(), db, conf, cities); err != nil {
+		t.Fatal(err)
+	}
+	if !p.shouldSkip("jaipur", 0, 0, 1) || p.shouldSkip("jaipur", 2, 0, 1) {
+		t.Error("removed overrides still apply")
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"math/rand/v2"
+	"os"
+	"sync"
+)
+
+const (
+	sourceTypeGoogle    = "google"
+	sourceTypeReplay    = "replay"
+	sourceTypeSynthetic = "synthetic"
+
+	readinessNetworkIdle  = "network_idle"
+	readinessSelector     = "selector"
+	readinessStableFrames = "stable_frames"
+
+	defaultReadinessTimeoutSeconds = 30
+	defaultStableFrames            = 3
+	defaultFrameIntervalMillis     = 500
+
+	syntheticRoadsPerTile = 12
+	syntheticRoadWidth    = 6
+	syntheticBlockSize    = 80
+)
+
+var (
+	syntheticBackground = color.RGBA{232, 234, 237, 255}
+	syntheticStreet     = color.RGBA{255, 255, 255, 255}
+)
+
+// TileSource provides the PNG screenshot of a single grid cell. Sources that
+// wait for the page to render record the time taken in cell.TimeToReadyMillis.
+type TileSource interface {
+	Fetch(ctx context.Context, cell *manifestCell) ([]byte, error)
+	Close()
+}
+
+type sourceConfig struct {
+	Type string `json:"type"`
+
+	// used only by the google source
+	Browsers       int             `json:"browsers"`
+	BrowserMaxUses int             `json:"browser_max_uses"`
+	Readiness      readinessConfig `json:"readiness"`
+
+	// used only by the replay source
+	ReplayFolder string `json:"replay_folder"`
+	ReplayPrefix string `json:"replay_prefix"`
+}
+
+// readinessConfig decides when a page is considered rendered and ready for capture:
+//   - network_idle: no network request for a while after the page is loaded
+//   - selector: an element matching the selector exists in the page
+//   - stable_frames: consecutive frames taken at an interval are identical
+type readinessConfig struct {
+	Strategy            string `json:"strategy"`
+	Selector            string `json:"selector"`
+	TimeoutSeconds      int    `json:"timeout_seconds"`
+	StableFrames        int    `json:"stable_frames"`
+	FrameIntervalMillis int    `json:"frame_interval_millis"`
+}
+
+func newTileSource(conf sourceConfig, p *palette) (TileSource, error) {
+	switch conf.Type {
+	case "", sourceTypeGoogle:
+		readiness, err := conf.Readiness.withDefaults()
+		if err != nil {
+			return nil, err
+		}
+		return &googleMapsSource{
+			numBrowsers:    conf.Browsers,
+			browserMaxUses: conf.BrowserMaxUses,
+			readiness:      readiness,
+		}, nil
+	case sourceTypeReplay:
+		if conf.ReplayFolder == "" || conf.ReplayPrefix == "" {
+			return nil, fmt.Errorf("replay source needs both replay_folder and replay_prefix")
+		}
+		return &replaySource{folder: conf.ReplayFolder, prefix: conf.ReplayPrefix}, nil
+	case sourceTypeSynthetic:
+		var colors []color.RGBA
+		for _, class := range p.classes {
+			colors = append(colors, class.color)
+		}
+		return &syntheticSource{colors: colors}, nil
+	default:
+		return nil, fmt.Errorf("unknown tile source [%v]", conf.Type)
+	}
+}
+
+// googleMapsSource takes a screenshot of the traffic layer of Google Maps.
+// The browsers are launched when first used and reused until Close.
+type googleMapsSource struct {
+	numBrowsers    int
+	browserMaxUses int
+	readiness      readinessConfig
+
+	mu   sync.Mutex
+	pool *browserPool
+}
+
+func (s *googleMapsSource) Fetch(ctx context.Context, cell *manifestCell) ([]byte, error) {
+	data, timeToReady, err := s.browserPool().screenshot(ctx, cell.URL, s.readiness)
+	cell.TimeToReadyMillis = timeToReady.Milliseconds()
+	return data, err
+}
+
+func (s *googleMapsSource) browserPool() *browserPool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.pool == nil {
+		s.pool = newBrowserPool(s.numBrowsers, s.browserMaxUses)
+	}
+	return s.pool
+}
+
+func (s *googleMapsSource) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.pool != nil {
+		s.pool.close()
+		s.pool = nil
+	}
+}
+
+func (r readinessConfig) withDefaults() (readinessConfig, error) {
+	if r.Strategy == "" {
+		r.Strategy = readinessNetworkIdle
+	}
+	if r.TimeoutSeconds <= 0 {
+		r.TimeoutSeconds = defaultReadinessTimeoutSeconds
+	}
+	if r.StableFrames <= 0 {
+		r.StableFrames = defaultStableFrames
+	}
+	if r.FrameIntervalMillis <= 0 {
+		r.FrameIntervalMillis = defaultFrameIntervalMillis
+	}
+
+	switch r.Strategy {
+	case readinessNetworkIdle, readinessStableFrames:
+	case readinessSelector:
+		if r.Selector == "" {
+			return r, fmt.Errorf("readiness strategy [%v] needs a selector", r.Strategy)
+		}
+	default:
+		return r, fmt.Errorf("unknown readiness strategy [%v]", r.Strategy)
+	}
+	return r, nil
+}
+
+// replaySource serves screenshots captured earlier in a round with the given prefix.
+type replaySource struct {
+	folder string
+	prefix string
+}
+
+func (s *replaySource) Fetch(_ context.Context, cell *manifestCell) ([]byte, error) {
+	fileName := fmt.Sprintf(fileNameFmt, s.folder, s.prefix, cell.X, cell.Y)
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, fmt.Errorf("error in reading replay screenshot [%v]: %w", fileName, err)
+	}
+	return data, nil
+}
+
+func (s *replaySource) Close() {}
+
+// syntheticSource paints a grid of streets and a few horizontal and vertical road
+// segments in traffic colors. The tile of a cell is always the same so that the
+// results are reproducible.
+type syntheticSource struct {
+	colors []color.RGBA
+}
+
+func (s *syntheticSource) Fetch(_ context.Context, cell *manifestCell) ([]byte, error) {
+	img := image.NewRGBA(image.Rect(0, 0, imageWidth, imageHeight))
+	draw.Draw(img, img.Bounds(), &image.Uniform{syntheticBackground}, image.Point{}, draw.Src)
+	for i := 0; i < imageWidth; i += syntheticBlockSize {
+		draw.Draw(img, image.Rect(i, 0, i+syntheticRoadWidth, imageHeight),
+			&image.Uniform{syntheticStreet}, image.Point{}, draw.Src)
+	}
+	for i := 0; i < imageHeight; i += syntheticBlockSize {
+		draw.Draw(img, image.Rect(0, i, imageWidth, i+syntheticRoadWidth),
+			&image.Uniform{syntheticStreet}, image.Point{}, draw.Src)
+	}
+
+	rnd := rand.New(rand.NewPCG(uint64(cell.X), uint64(cell.Y)))
+	for range syntheticRoadsPerTile {
+		minX := imageToLeaveOnLeft + rnd.IntN(imageWidthWithLeaveOuts-syntheticRoadWidth)
+		minY := imageToLeaveOnTop + rnd.IntN(imageHeightWithLeaveOuts-syntheticRoadWidth)
+		length := 50 + rnd.IntN(250)
+
+		var rect image.Rectangle
+		if rnd.IntN(2) == 0 {
+			rect = image.Rect(minX, minY, minX+length, minY+syntheticRoadWidth)
+		} else {
+			rect = image.Rect(minX, minY, minX+syntheticRoadWidth, minY+length)
+		}
+
+		c := s.colors[rnd.IntN(len(s.colors))]
+		draw.Draw(img, rect, &image.Uniform{c}, image.Point{}, draw.Src)
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, fmt.Errorf("error in encoding synthetic tile: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+func (s *syntheticSource) Close() {}
@@ -1,122 +1,155 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"math"
 	"os"
 	"time"
 
-	"github.com/luabagg/orcgen/v2"
 	"golang.org/x/sync/errgroup"
 )
 
 const (
-	mapsURLForTraffic = "https://www.google.com/maps/@%7f,%7f,1200m/data=!3m1!1e3!5m1!1e1"
-	ssHeightMeters    = 1100
-	ssWidthMeters     = 1800
-
-	/*
-		26.99 ------------
-		  |
-		  |    LATITUDE (y)
-		  |
-		26.78 ------------
-
-		  |                   |
-		75.65 LONGITUDE (x) 75.92
-		  |                   |
-	*/
-	jaipurNorthWestLatitude  = 26.99
-	jaipurSouthEastLatitude  = 26.75
-	jaipurNorthWestLongitude = 75.65
-	jaipurSouthEastLongitude = 75.94
+	mapsURLForTraffic = "https://www.google.com/maps/@%7f,%7f,%vm/data=!3m1!1e3!5m1!1e1"
 
 	maxRoutine      = 10
 	metersPerDegree = 111320
 	fileNameFmt     = "%v/%v-x%v-y%v.png"
 	combFileNameFmt = "%v/%v.png"
+	prefixFmt       = "%v-%v"
 )
 
-func takeGridScreenshots(quit <-chan os.Signal) (string, error) {
-	nowStr := time.Now().Format("20060102-150405")
-	log.Printf("---- taking screenshots for Jaipur at %v ----", nowStr)
+func takeGridScreenshots(ctx context.Context, city *cityConfig, source TileSource,
+	capture captureConfig, cadence roundCadence) (*captureManifest, error) {
+
+	now := time.Now()
+	nowStr := now.Format("20060102-150405")
+	prefix := fmt.Sprintf(prefixFmt, nowStr, city.Name)
+	log.Printf("---- taking screenshots for %v at %v ----", city.Name, nowStr)
 	defer log.Println("---- screenshots taken ----")
 
-	// latitude is vertical => y, longitude is horizontal => x
-	var x, y int
-	lat := addMetersInLatitude(jaipurNorthWestLatitude, ssHeightMeters/2)
-	long := addMetersInLongitude(lat, jaipurNorthWestLongitude, ssWidthMeters/2)
+	manifest := newCaptureManifest(city, prefix, now)
+	manifest.IntervalMinutes = int(cadence.Interval / time.Minute)
+	round := sampling.startRound(city.Name)
 
+	excluded := 0
 	var g errgroup.Group
 	g.SetLimit(maxRoutine)
-	defer func() {
-		if err := g.Wait(); err != nil {
-			log.Printf("error in taking screenshot: %v", err)
-		}
-	}()
-
-	for {
+	for _, cell := range manifest.Cells {
 		select {
-		case <-quit:
-			return "", fmt.Errorf("ctrl+c pressed")
+		case <-ctx.Done():
+			if err := g.Wait(); err != nil {
+				log.Printf("error in taking screenshot: %v", err)
+			}
+			return nil, fmt.Errorf("capture cancelled: %w", ctx.Err())
 		default:
 		}
 
-		latTemp := lat
-		longTemp := long
-		xTemp := x
-		yTemp := y
+		if exclusions.excluded(city.Name, cell.X, cell.Y, round) {
+			cell.Status = cellStatusExcluded
+			excluded++
+			continue
+		}
+
+		skip := !cadence.hot(cell.X, cell.Y) && sampling.shouldSkip(city.Name, cell.X, cell.Y, round)
 		g.Go(func() error {
-			return takeScreenshot(latTemp, longTemp, xTemp, yTemp, nowStr)
+			return takeScreenshot(ctx, source, capture, manifest, cell, skip)
 		})
+	}
 
-		x += 1
-		long = addMetersInLongitude(lat, long, ssWidthMeters)
-		if long > jaipurSouthEastLongitude {
-			y += 1
-			x = 0
-			lat = addMetersInLatitude(lat, ssHeightMeters)
-			long = addMetersInLongitude(lat, jaipurNorthWestLongitude, ssWidthMeters/2)
-		}
-		if lat < jaipurSouthEastLatitude {
-			break
-		}
+	if err := g.Wait(); err != nil {
+		log.Printf("error in taking screenshot: %v", err)
+	}
+	if excluded > 0 {
+		log.Printf("excluded [%v] cells of %v from the round", excluded, city.Name)
+	}
+	// an interrupted round is not saved, its interrupted cells would count as failed
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("capture cancelled: %w", err)
+	}
+
+	manifest.updateStatus(capture.MinCoverage)
+	observeCaptureRound(manifest, time.Since(now))
+	log.Printf("captured [%.1f%%] of the cells for %v at %v, round is %v",
+		manifest.Coverage*100, city.Name, nowStr, manifest.Status)
+	if err := manifest.save(); err != nil {
+		return nil, err
 	}
 
-	return nowStr, nil
+	return manifest, nil
 }
 
-func takeScreenshot(latitude, longitude float64, x, y int, nowStr string) error {
-	if shouldSkip(x, y) {
+func takeScreenshot(ctx context.Context, source TileSource, capture captureConfig,
+	manifest *captureManifest, cell *manifestCell, skip bool) (err error) {
+
+	x, y := cell.X, cell.Y
+	if skip {
 		log.Printf("skipping screenshot for a low frequency cell [y:%v, x:%v]", y, x)
+		cell.Status = cellStatusSkipped
 		return nil
 	}
 
-	mapsURL := fmt.Sprintf(mapsURLForTraffic, latitude, longitude)
 	log.Printf("taking screenshot for [y:%v, x:%v] latitude: %f, longitude: %f at [%v]",
-		y, x, latitude, longitude, mapsURL)
+		y, x, cell.Latitude, cell.Longitude, cell.URL)
 
 	defer func() {
 		if r := recover(); r != nil {
 			log.Printf("error: recovered panic: %v", r)
+			err = fmt.Errorf("recovered panic: %v", r)
+		}
+
+		cell.CapturedAt = time.Now()
+		if err != nil {
+			cell.Status = cellStatusFailed
+			cell.Error = err.Error()
+		} else {
+			cell.Status = cellStatusCaptured
 		}
 	}()
 
-	h := orcgen.NewHandler(orcgen.ScreenshotConfig{FromSurface: true})
-	pngPass, err := orcgen.ConvertWebpage(h, mapsURL)
+	pngData, err := fetchTile(ctx, source, capture, cell)
 	if err != nil {
-		return fmt.Errorf("error while loading the webpage: %w", err)
+		return err
 	}
 
-	fileName := fmt.Sprintf(fileNameFmt, ssFolder, nowStr, x, y)
-	if err := os.WriteFile(fileName, pngPass.File, 0644); err != nil {
+	fileName := manifest.ssPath(cell)
+	if err := os.WriteFile(fileName, pngData, 0644); err != nil {
 		return fmt.Errorf("error while writing the screenshot file: %w", err)
 	}
 
 	return nil
 }
 
+// fetchTile fetches and validates the tile, retrying with exponential backoff on failure.
+func fetchTile(ctx context.Context, source TileSource, capture captureConfig, cell *manifestCell) ([]byte, error) {
+	backoff := time.Duration(capture.RetryBackoffSeconds) * time.Second
+	for attempt := 0; ; attempt++ {
+		cell.Retries = attempt
+
+		pngData, err := source.Fetch(ctx, cell)
+		if err == nil {
+			err = validateTile(pngData, capture.MaxUniformFraction)
+		}
+		if err == nil {
+			return pngData, nil
+		}
+
+		if attempt >= capture.Retries || ctx.Err() != nil {
+			return nil, err
+		}
+
+		log.Printf("retrying screenshot for [y:%v, x:%v] in [%v] after error: %v", cell.Y, cell.X, backoff, err)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
 func addMetersInLatitude(latitude float64, meter int) float64 {
 	return latitude - float64(meter)/metersPerDegree
 }
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+const (
+	stageDashboard = "dashboard"
+
+	initialRestartBackoff = 5 * time.Second
+	maxRestartBackoff     = 5 * time.Minute
+	// a stage that ran for this long before exiting is restarted with the initial backoff
+	restartBackoffReset = 10 * time.Minute
+)
+
+// supervisor runs the stages of the pipeline until the context is cancelled. A stage
+// that returns, with or without an error, or panics before that is restarted after
+// an exponential backoff. The restarts are logged and reported in the metrics and
+// the health of the pipeline.
+type supervisor struct {
+	stages  []supervisedStage
+	backoff restartBackoff
+}
+
+// restartBackoff is the delay before restarting a stage, doubling from initial up to
+// max on each restart, and back to initial if the stage ran for reset before exiting.
+type restartBackoff struct {
+	initial time.Duration
+	max     time.Duration
+	reset   time.Duration
+}
+
+type supervisedStage struct {
+	name string
+	run  func(ctx context.Context) error
+}
+
+func newSupervisor() *supervisor {
+	return &supervisor{
+		backoff: restartBackoff{
+			initial: initialRestartBackoff,
+			max:     maxRestartBackoff,
+			reset:   restartBackoffReset,
+		},
+	}
+}
+
+func (s *supervisor) add(name string, run func(ctx context.Context) error) {
+	s.stages = append(s.stages, supervisedStage{name: name, run: run})
+}
+
+// run blocks until the context is cancelled and all the stages have returned.
+func (s *supervisor) run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, stage := range s.stages {
+		wg.Go(func() {
+			s.supervise(ctx, stage)
+		})
+	}
+	wg.Wait()
+}
+
+func (s *supervisor) supervise(ctx context.Context, stage supervisedStage) {
+	var backoff time.Duration
+	for restarts := 0; ; restarts++ {
+		pipeline.start(stage.name)
+		start := time.Now()
+		err := runStage(ctx, stage)
+		ranFor := time.Since(start)
+		pipeline.stop(stage.name)
+
+		if ctx.Err() != nil {
+			log.Printf("stage [%v] stopped", stage.name)
+			return
+		}
+
+		if err == nil {
+			err = fmt.Errorf("stage exited")
+		}
+		backoff = s.backoff.delay(backoff, ranFor)
+		stageRestartsTotal.WithLabelValues(stage.name).Inc()
+		pipeline.restarted(stage.name, err)
+		log.Printf("stage [%v] failed after [%v], restart [%v] in [%v]: %v",
+			stage.name, ranFor.Round(time.Second), restarts+1, backoff, err)
+
+		select {
+		case <-ctx.Done():
+			log.Printf("stage [%v] stopped", stage.name)
+			return
+		case <-time.After(backoff):
+		}
+	}
+}
+
+// delay returns the delay before restarting a stage that ran for ranFor,
+// given the previous delay, which is zero before the first restart.
+func (b restartBackoff) delay(previous, ranFor time.Duration) time.Duration {
+	if previous == 0 || ranFor >= b.reset {
+		return b.initial
+	}
+	return min(2*previous, b.max)
+}
+
+// runStage runs the stage, converting a panic into an error.
+func runStage(ctx context.Context, stage supervisedStage) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v\n%s", r, debug.Stack())
+		}
+	}()
+	return stage.run(ctx)
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// newTestSupervisor restarts the stages without waiting long.
+func newTestSupervisor() *supervisor {
+	s := newSupervisor()
+	s.backoff = restartBackoff{initial: time.Millisecond, max: 4 * time.Millisecond, reset: time.Hour}
+	return s
+}
+
+func TestSupervisorRestartsPanickedStage(t *testing.T) {
+	const name = "test-panic"
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// the pipeline and the metrics are global, only the restarts of this run count
+	var restartsBefore int
+	if stages, _, _ := pipeline.report(defaultHealthConfig()); stages[name] != nil {
+		restartsBefore = stages[name].Restarts
+	}
+	metricBefore := testutil.ToFloat64(stageRestartsTotal.WithLabelValues(name))
+
+	var runs atomic.Int32
+	restarted := make(chan struct{})
+	s := newTestSupervisor()
+	s.add(name, func(ctx context.Context) error {
+		if runs.Add(1) == 1 {
+			panic("boom")
+		}
+		close(restarted)
+		<-ctx.Done()
+		return ctx.Err()
+	})
+
+	done := make(chan struct{})
+	go func() {
+		s.run(ctx)
+		close(done)
+	}()
+
+	select {
+	case <-restarted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("stage is not restarted after the panic")
+	}
+	stages, _, _ := pipeline.report(defaultHealthConfig())
+	if stage := stages[name]; !stage.Alive || stage.Restarts != restartsBefore+1 || !strings.HasPrefix(stage.LastError, "panic: boom") {
+		t.Errorf("restarted stage = %+v, want alive with a restart after the panic", stage)
+	}
+	if restarts := testutil.ToFloat64(stageRestartsTotal.WithLabelValues(name)) - metricBefore; restarts != 1 {
+		t.Errorf("restarts metric grew by %v, want 1", restarts)
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("supervisor is running after the context is cancelled")
+	}
+	if runs.Load() != 2 {
+		t.Errorf("stage ran %v times, want 2", runs.Load())
+	}
+	if stages, _, _ := pipeline.report(defaultHealthConfig()); stages[name].Alive {
+		t.Error("stage is alive after the context is cancelled")
+	}
+}
+
+func TestSupervisorStopsDuringBackoff(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	s := newSupervisor()
+	s.backoff.initial = time.Hour
+	s.add("test-backoff", func(ctx context.Context) error {
+		cancel()
+		return errors.New("failed")
+	})
+
+	done := make(chan struct{})
+	go func() {
+		s.run(ctx)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("supervisor waits for the backoff after the context is cancelled")
+	}
+}
+
+func TestSupervisorRestartsFailingStage(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var runs atomic.Int32
+	s := newTestSupervisor()
+	s.add("test-failing", func(ctx context.Context) error {
+		if runs.Add(1) == 5 {
+			cancel()
+			return nil
+		}
+		return errors.New("failed")
+	})
+	s.run(ctx)
+	if runs.Load() != 5 {
+		t.Errorf("stage ran %v times, want 5", runs.Load())
+	}
+}
+
+func TestRestartBackoffDelay(t *testing.T) {
+	b := restartBackoff{initial: 5 * time.Second, max: 30 * time.Second, reset: 10 * time.Minute}
+
+	tests := []struct {
+		name     string
+		previous time.Duration
+		ranFor   time.Duration
+		want     time.Duration
+	}{
+		{"first restart", 0, time.Second, 5 * time.Second},
+		{"doubles", 5 * time.Second, time.Second, 10 * time.Second},
+		{"doubles again", 10 * time.Second, time.Minute, 20 * time.Second},
+		{"capped at max", 20 * time.Second, time.Second, 30 * time.Second},
+		{"stays at max", 30 * time.Second, time.Second, 30 * time.Second},
+		{"reset after a long run", 30 * time.Second, 10 * time.Minute, 5 * time.Second},
+	}
+
+	for _, tt := range tests {
+		if got := b.delay(tt.previous, tt.ranFor); got != tt.want {
+			t.Errorf("%v: delay = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
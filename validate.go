@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+)
+
+const (
+	// every n-th pixel in both directions is sampled to check uniformity
+	validateSampleStep = 4
+)
+
+var (
+	errBlankTile = errors.New("tile is blank or not loaded")
+)
+
+// validateTile rejects screenshots that do not look like a rendered map, such as a
+// blank page, a consent page or a page still loading. These pages are dominated by
+// a single color while a map has roads, labels and blocks in the visible region.
+func validateTile(pngData []byte, maxUniformFraction float64) error {
+	img, _, err := image.Decode(bytes.NewReader(pngData))
+	if err != nil {
+		return fmt.Errorf("error decoding png image: %w", err)
+	}
+
+	if img.Bounds().Dx() != imageWidth || img.Bounds().Dy() != imageHeight {
+		return fmt.Errorf("unexpected tile size [%v x %v]", img.Bounds().Dx(), img.Bounds().Dy())
+	}
+
+	counts := make(map[uint32]int)
+	total := 0
+	for y := imageToLeaveOnTop; y < imageToLeaveOnTop+imageHeightWithLeaveOuts; y += validateSampleStep {
+		for x := imageToLeaveOnLeft; x < imageToLeaveOnLeft+imageWidthWithLeaveOuts; x += validateSampleStep {
+			r, g, b, _ := img.At(x, y).RGBA()
+			counts[(r>>8)<<16|(g>>8)<<8|(b>>8)]++
+			total++
+		}
+	}
+
+	dominant := 0
+	for _, count := range counts {
+		dominant = max(dominant, count)
+	}
+
+	if fraction := float64(dominant) / float64(total); fraction > maxUniformFraction {
+		return fmt.Errorf("%w: [%.2f] of the tile has the same color", errBlankTile, fraction)
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/png"
+	"testing"
+)
+
+// newTestTile returns the png of a tile whose cropped region has the top fraction
+// of its rows in one color and the rest in another, and is black outside of it.
+func newTestTile(t *testing.T, width, height int, fraction float64) []byte {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	split := imageToLeaveOnTop + int(fraction*imageHeightWithLeaveOuts)
+	for y := range height {
+		for x := range width {
+			c := color.RGBA{A: 255}
+			switch {
+			case x < imageToLeaveOnLeft || x >= imageToLeaveOnLeft+imageWidthWithLeaveOuts ||
+				y < imageToLeaveOnTop || y >= imageToLeaveOnTop+imageHeightWithLeaveOuts:
+			case y < split:
+				c = color.RGBA{R: 232, G: 234, B: 237, A: 255}
+			default:
+				c = color.RGBA{R: 99, G: 214, B: 104, A: 255}
+			}
+			img.Set(x, y, c)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestValidateTile(t *testing.T) {
+	tests := []struct {
+		name          string
+		data          []byte
+		maxUniform    float64
+		wantErr       bool
+		wantBlankTile bool
+	}{
+		{
+			name:          "uniform",
+			data:          newTestTile(t, imageWidth, imageHeight, 1),
+			maxUniform:    0.95,
+			wantErr:       true,
+			wantBlankTile: true,
+		},
+		{
+			name:       "half and half",
+			data:       newTestTile(t, imageWidth, imageHeight, 0.5),
+			maxUniform: 0.95,
+		},
+		{
+			name:          "half and half with a lower threshold",
+			data:          newTestTile(t, imageWidth, imageHeight, 0.5),
+			maxUniform:    0.4,
+			wantErr:       true,
+			wantBlankTile: true,
+		},
+		{
+			name:       "just below the threshold",
+			data:       newTestTile(t, imageWidth, imageHeight, 0.9),
+			maxUniform: 0.95,
+		},
+		{
+			name:          "just above the threshold",
+			data:          newTestTile(t, imageWidth, imageHeight, 0.98),
+			maxUniform:    0.95,
+			wantErr:       true,
+			wantBlankTile: true,
+		},
+		{
+			name:       "unexpected size",
+			data:       newTestTile(t, imageWidth/2, imageHeight, 0.5),
+			maxUniform: 0.95,
+			wantErr:    true,
+		},
+		{
+			name:       "not a png",
+			data:       []byte("<html>consent</html>"),
+			maxUniform: 0.95,
+			wantErr:    true,
+		},
+	}
+
+	for _, tt := range tests {
+		err := validateTile(tt.data, tt.maxUniform)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%v: validateTile() error = %v, want error %v", tt.name, err, tt.wantErr)
+		}
+		if errors.Is(err, errBlankTile) != tt.wantBlankTile {
+			t.Errorf("%v: validateTile() error = %v, want blank tile %v", tt.name, err, tt.wantBlankTile)
+		}
+	}
+}